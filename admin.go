@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// HostSettings are the parts of HostConfig an owner may change remotely
+type HostSettings struct {
+	RegistrationEnabled bool
+	AuthMode            int
+	AdminsNeedBoth      bool
+	MaxAuthFailures     int
+	PublicAddress       string
+}
+
+func (config *HostConfig) Settings() HostSettings {
+	config.Lock()
+	defer config.Unlock()
+	return HostSettings{
+		RegistrationEnabled: config.RegistrationEnabled,
+		AuthMode:            config.AuthMode,
+		AdminsNeedBoth:      config.AdminsNeedBoth,
+		MaxAuthFailures:     config.MaxAuthFailures,
+		PublicAddress:       config.PublicAddress,
+	}
+}
+
+func (config *HostConfig) ApplySettings(settings HostSettings) error {
+	if settings.AuthMode != AuthModePassword && settings.AuthMode != AuthModeKey {
+		return errors.New("unknown auth mode")
+	}
+	if settings.MaxAuthFailures < 0 {
+		return errors.New("max auth failures can't be negative")
+	}
+	if err := checkPublicAddress(settings.PublicAddress); err != nil {
+		return err
+	}
+	config.Lock()
+	config.RegistrationEnabled = settings.RegistrationEnabled
+	config.AuthMode = settings.AuthMode
+	config.AdminsNeedBoth = settings.AdminsNeedBoth
+	config.MaxAuthFailures = settings.MaxAuthFailures
+	config.PublicAddress = settings.PublicAddress
+	config.Unlock()
+	return nil
+}
+
+// MemberInfo describes a user and their session for remote admins
+type MemberInfo struct {
+	Name     string
+	Role     Role
+	Verified bool
+	Online   bool
+	Remote   string
+	Since    time.Time // session start, zero while offline
+}
+
+func (config *HostConfig) Members() (members []MemberInfo) {
+	config.Lock()
+	defer config.Unlock()
+	for _, user := range config.Users {
+		member := MemberInfo{
+			Name:     user.Name,
+			Role:     user.Role,
+			Verified: user.Verified,
+		}
+		if user.Session != nil {
+			member.Online = true
+			member.Remote = user.Session.Remote
+			member.Since = user.Session.Started
+		}
+		members = append(members, member)
+	}
+	return
+}
+
+// SetRole changes username's role; by is the owner acting remotely, empty
+// for the host itself
+func (config *HostConfig) SetRole(username string, role Role, by string) error {
+	if role < RoleGuest || role > RoleOwner {
+		return errors.New("unknown role")
+	}
+	config.Lock()
+	defer config.Unlock()
+	target := config.findUser(username)
+	if target == nil {
+		return errors.New("no user '" + username + "'")
+	}
+	if by != "" {
+		actor := config.findUser(by)
+		switch {
+		case actor == nil || !actor.Role.Can(PermissionManageRoles):
+			return errors.New("not allowed to change roles")
+		case actor == target:
+			return errors.New("can't change your own role")
+		case !actor.Role.Outranks(target.Role) || role > actor.Role:
+			return errors.New("not allowed to change the role of '" + username + "'")
+		}
+	}
+	if role >= RoleAdmin && config.AdminsNeedBoth && !target.HasPassword() {
+		return errors.New("'" + username + "' has no password, admins need both a key and a password")
+	}
+	target.Role = role
+	return nil
+}
+
+// HasPassword reports whether user can answer a password challenge, as
+// opposed to having registered with only a key
+func (user *User) HasPassword() bool {
+	return user.Verifier != nil || user.HashedPassword != nil
+}
+
+// AdminAction is one administrative request and its outcome
+type AdminAction struct {
+	Username string // empty for the host itself
+	Remote   string
+	Action   string
+	Target   string
+	Error    string // why it was refused or failed, empty on success
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditHostStarted           = "host-started"
+	AuditLogin                 = "login"
+	AuditLoginFailed           = "login-failed"
+	AuditLockout               = "lockout"
+	AuditKeyMismatch           = "key-mismatch"
+	AuditKeyPinned             = "key-pinned"
+	AuditRegistrationRequested = "registration-requested"
+	AuditRegistrationAllowed   = "registration-allowed"
+	AuditRegistrationDenied    = "registration-denied"
+	AuditRegistrationExpired   = "registration-expired"
+	AuditRegistrationWithdrawn = "registration-withdrawn"
+	AuditInviteRedeemed        = "invite-redeemed"
+	AuditVerify                = "verify"
+	AuditKick                  = "kick"
+	AuditAdmin                 = "admin"
+	AuditLogBroken             = "log-broken"
+)
+
+var AuditKinds = []string{
+	AuditHostStarted, AuditLogin, AuditLoginFailed, AuditLockout,
+	AuditKeyMismatch, AuditKeyPinned, AuditRegistrationRequested,
+	AuditRegistrationAllowed, AuditRegistrationDenied, AuditRegistrationExpired,
+	AuditRegistrationWithdrawn, AuditInviteRedeemed, AuditVerify, AuditKick,
+	AuditAdmin, AuditLogBroken,
+}
+
+// auditMemoryEvents is how many of the newest entries a log keeps in memory
+// for browsing and export; older ones are only on disk
+const auditMemoryEvents = 10000
+
+// AuditEvent is one entry of the audit log; Hash covers the entry and the
+// hash before it, so editing or dropping an entry breaks the chain
+type AuditEvent struct {
+	Seq      int64
+	Time     time.Time
+	Kind     string
+	Username string
+	Actor    string // admin who caused it, empty for the host or the user themselves
+	Key      string // hex public key involved, if any
+	Remote   string
+	Detail   string
+	PrevHash string
+	Hash     string
+}
+
+func (event AuditEvent) computeHash() string {
+	event.Hash = ""
+	encoded, _ := json.Marshal(event)
+	digest := sha256.Sum256(append([]byte(event.PrevHash), encoded...))
+	return hex.EncodeToString(digest[:])
+}
+
+func (event AuditEvent) matches(filter AuditFilter) bool {
+	if filter.Kind != "" && event.Kind != filter.Kind {
+		return false
+	}
+	if filter.Text == "" {
+		return true
+	}
+	text := strings.ToLower(filter.Text)
+	for _, field := range []string{event.Username, event.Actor, event.Key, event.Remote, event.Detail} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
+		}
+	}
+	return false
+}
+
+type AuditFilter struct {
+	Kind string // empty for every kind
+	Text string // substring of username, actor, key, remote or detail
+}
+
+// AuditLog is an append-only, hash-chained record of security relevant host
+// events, mirrored to a JSON lines file if it has a path
+type AuditLog struct {
+	mutex  sync.Mutex
+	file   *os.File
+	events []AuditEvent // the newest, at most limit of them
+	limit  int
+	seq    int64  // of the last entry
+	prev   string // hash of the last entry
+	broken int64  // first entry that didn't check out on load, 0 if none
+}
+
+func auditKey(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+// OpenAuditLog loads and checks the existing log at path and appends to it;
+// an empty path keeps the log in memory only. A log that was cut short or
+// edited is still appended to, after an entry recording where it broke.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	audit := &AuditLog{limit: auditMemoryEvents}
+	if path == "" {
+		return audit, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	line := int64(0)
+	torn, noted := false, false
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			line++
+			torn = data[len(data)-1] != '\n'
+			var event AuditEvent
+			if json.Unmarshal(data, &event) != nil {
+				audit.breakAt(line)
+				continue
+			}
+			if event.Seq != audit.seq+1 || event.PrevHash != audit.prev || event.computeHash() != event.Hash {
+				audit.breakAt(line)
+			}
+			audit.keep(event)
+			noted = noted || event.Kind == AuditLogBroken && event.Detail == auditBrokenDetail(audit.broken)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	audit.file = file
+	if torn {
+		// a write cut short by a crash, the next entry goes on a line of its own
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if audit.broken != 0 && !noted {
+		if err := audit.Append(AuditEvent{Kind: AuditLogBroken, Detail: auditBrokenDetail(audit.broken)}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return audit, nil
+}
+
+func auditBrokenDetail(entry int64) string {
+	return fmt.Sprintf("entry %d doesn't fit the chain", entry)
+}
+
+// breakAt records line as where the chain broke, unless it broke earlier
+func (audit *AuditLog) breakAt(line int64) {
+	if audit.broken == 0 {
+		audit.broken = line
+	}
+}
+
+// keep adds event as the last entry, dropping the oldest from memory once
+// there are more than limit; mutex must be held or not yet shared
+func (audit *AuditLog) keep(event AuditEvent) {
+	audit.seq = event.Seq
+	audit.prev = event.Hash
+	audit.events = append(audit.events, event)
+	if over := len(audit.events) - audit.limit; over > 0 {
+		audit.events = audit.events[over:]
+	}
+}
+
+// check walks the chain kept in memory and returns the sequence number of
+// the first entry that doesn't fit, 0 if all do; mutex must be held
+func (audit *AuditLog) check() int64 {
+	if len(audit.events) == 0 {
+		return 0
+	}
+	prev := audit.events[0].PrevHash
+	for i, event := range audit.events {
+		if event.Seq != audit.events[0].Seq+int64(i) || event.PrevHash != prev || event.computeHash() != event.Hash {
+			return event.Seq
+		}
+		prev = event.Hash
+	}
+	return 0
+}
+
+// Verify rechecks the chain, returning the first bad entry or 0
+func (audit *AuditLog) Verify() int64 {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.broken != 0 {
+		return audit.broken
+	}
+	return audit.check()
+}
+
+func (audit *AuditLog) Append(event AuditEvent) error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+
+	event.Seq = audit.seq + 1
+	event.Time = time.Now().UTC()
+	event.PrevHash = audit.prev
+	event.Hash = event.computeHash()
+	audit.keep(event)
+
+	if audit.file == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := audit.file.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	return audit.file.Sync()
+}
+
+// Close stops mirroring to the file; the entries in memory stay readable
+func (audit *AuditLog) Close() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.file.Close()
+	audit.file = nil
+	return err
+}
+
+// Events returns the entries matching filter, newest first, at most limit
+// of them if limit is positive
+func (audit *AuditLog) Events(filter AuditFilter, limit int) (events []AuditEvent) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	for i := len(audit.events) - 1; i >= 0; i-- {
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		if audit.events[i].matches(filter) {
+			events = append(events, audit.events[i])
+		}
+	}
+	return
+}
+
+// Export writes the entries matching filter as JSON lines, oldest first
+func (audit *AuditLog) Export(out io.Writer, filter AuditFilter) error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	encoder := json.NewEncoder(out)
+	for _, event := range audit.events {
+		if !event.matches(filter) {
+			continue
+		}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
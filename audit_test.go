@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testAuditPath(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "andromeda-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "audit.jsonl")
+}
+
+func reopenAudit(t *testing.T, path string) *AuditLog {
+	t.Helper()
+	audit, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { audit.Close() })
+	return audit
+}
+
+// a write cut short by a crash must not stop the host from auditing
+func TestAuditLogTornLine(t *testing.T) {
+	path := testAuditPath(t)
+	audit := reopenAudit(t, path)
+	audit.Append(AuditEvent{Kind: AuditLogin, Username: "alice"})
+	audit.Close()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Seq":2,"Kind":"lo`)
+	file.Close()
+
+	audit = reopenAudit(t, path)
+	if broken := audit.Verify(); broken != 2 {
+		t.Errorf("torn line reported as entry %d, want 2", broken)
+	}
+	if err := audit.Append(AuditEvent{Kind: AuditLogin, Username: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	audit = reopenAudit(t, path)
+	if len(audit.Events(AuditFilter{Kind: AuditLogin, Text: "bob"}, 0)) != 1 {
+		t.Error("entry appended after the torn line was lost")
+	}
+	if notes := len(audit.Events(AuditFilter{Kind: AuditLogBroken}, 0)); notes != 1 {
+		t.Errorf("break noted %d times, want once", notes)
+	}
+}
+
+func TestAuditLogKeepsNewest(t *testing.T) {
+	path := testAuditPath(t)
+	audit := reopenAudit(t, path)
+	audit.limit = 3
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		audit.Append(AuditEvent{Kind: AuditLogin, Username: name})
+	}
+	events := audit.Events(AuditFilter{}, 0)
+	if len(events) != 3 || events[0].Username != "e" || events[2].Username != "c" {
+		t.Errorf("kept %+v", events)
+	}
+	if broken := audit.Verify(); broken != 0 {
+		t.Errorf("chain of the newest entries breaks at %d", broken)
+	}
+	audit.Close()
+
+	if reopened := reopenAudit(t, path); len(reopened.Events(AuditFilter{}, 0)) != 5 || reopened.Verify() != 0 {
+		t.Error("entries dropped from memory are gone from disk")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// ClientSet holds the networks we are joined to at the same time, by ID
+type ClientSet struct {
+	sync.Mutex
+	next    int
+	clients map[int]*ClientConfig
+}
+
+func NewClientSet() *ClientSet {
+	return &ClientSet{clients: make(map[int]*ClientConfig)}
+}
+
+func (set *ClientSet) Add(client *ClientConfig) int {
+	set.Lock()
+	defer set.Unlock()
+	set.next++
+	client.ID = set.next
+	set.clients[client.ID] = client
+	return client.ID
+}
+
+// Get returns the client with id, nil once it has disconnected
+func (set *ClientSet) Get(id int) *ClientConfig {
+	set.Lock()
+	defer set.Unlock()
+	return set.clients[id]
+}
+
+func (set *ClientSet) Remove(id int) {
+	set.Lock()
+	delete(set.clients, id)
+	set.Unlock()
+}
+
+// List returns the connected clients, oldest first
+func (set *ClientSet) List() (clients []*ClientConfig) {
+	set.Lock()
+	defer set.Unlock()
+	for _, client := range set.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return
+}
+
+// Send queues a packet on client id's connection, dropping it if the client
+// is gone, not logged in yet or not keeping up
+func (set *ClientSet) Send(id int, packetID int, message interface{}) bool {
+	client := set.Get(id)
+	if client == nil {
+		return false
+	}
+	client.Lock()
+	queue := client.Queue
+	client.Unlock()
+	if queue == nil {
+		return false
+	}
+	return queue.Send(packetID, message) == nil
+}
+
+// Close hangs up on the host once packets already queued for it are sent
+func (client *ClientConfig) Close() error {
+	client.Lock()
+	queue := client.Queue
+	client.Unlock()
+	if queue != nil {
+		return queue.Close()
+	}
+	return client.Conn.Close()
+}
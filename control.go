@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The control API is JSON-RPC 2.0 over a Unix socket, one object per line.
+// Every net event can be sent by its name below with the NetReq as params,
+// the same as the GUI does; results show up as events to subscribers.
+// Anyone who can open the socket may do anything, so access is down to the
+// socket's file mode
+
+var netEventNames = []string{
+	NetEventHost:                  "host",
+	NetEventRegistration:          "registration",
+	NetEventJoin:                  "join",
+	NetEventJoinUnknownConnection: "join_unknown_connection",
+	NetEventVerify:                "verify",
+	NetEventKick:                  "kick",
+	NetEventRemoteRegistration:    "remote_registration",
+	NetEventRemoteKick:            "remote_kick",
+	NetEventSetRole:               "set_role",
+	NetEventRemoteQuery:           "remote_query",
+	NetEventRemoteSettings:        "remote_settings",
+	NetEventRemoteRole:            "remote_role",
+	NetEventLeave:                 "leave",
+	NetEventStopHost:              "stop_host",
+	NetEventChat:                  "chat",
+	NetEventSettings:              "settings",
+}
+
+// newNetRequest returns an empty NetReq for a net event, to decode params into
+func newNetRequest(id int) interface{} {
+	switch id {
+	case NetEventHost:
+		return &NetReqHost{}
+	case NetEventRegistration:
+		return &NetReqRegistration{}
+	case NetEventJoin:
+		return &NetReqJoin{}
+	case NetEventJoinUnknownConnection:
+		return &NetReqJoinUnknownConnection{}
+	case NetEventVerify:
+		return &NetReqVerify{}
+	case NetEventKick:
+		return &NetReqKick{}
+	case NetEventRemoteRegistration:
+		return &NetReqRemoteRegistration{}
+	case NetEventRemoteKick:
+		return &NetReqRemoteKick{}
+	case NetEventSetRole:
+		return &NetReqSetRole{}
+	case NetEventRemoteQuery:
+		return &NetReqRemoteQuery{}
+	case NetEventRemoteSettings:
+		return &NetReqRemoteSettings{}
+	case NetEventRemoteRole:
+		return &NetReqRemoteRole{}
+	case NetEventLeave:
+		return &NetReqLeave{}
+	case NetEventStopHost:
+		return &NetReqStopHost{}
+	case NetEventChat:
+		return &NetReqChat{}
+	case NetEventSettings:
+		return &NetReqSettings{}
+	}
+	return nil
+}
+
+var guiEventNames = []string{
+	GuiEventShowMain:                  "show_main",
+	GuiEventShowMessage:               "show_message",
+	GuiEventShowHost:                  "show_host",
+	GuiEventShowHostReady:             "show_host_ready",
+	GuiEventShowHostRegistrations:     "show_host_registrations",
+	GuiEventShowJoin:                  "show_join",
+	GuiEventShowJoinUnknownConnection: "show_join_unknown_connection",
+	GuiEventShowJoinOurHostKey:        "show_join_our_host_key",
+	GuiEventShowLog:                   "show_log",
+	GuiEventShowIdentity:              "show_identity",
+	GuiEventShowAlert:                 "show_alert",
+	GuiEventHostChanged:               "host_changed",
+	GuiEventShowHostInvites:           "show_host_invites",
+	GuiEventShowVerify:                "show_verify",
+	GuiEventShowSession:               "show_session",
+	GuiEventSessionChanged:            "session_changed",
+	GuiEventShowAudit:                 "show_audit",
+	GuiEventClientsChanged:            "clients_changed",
+	GuiEventShowUnlockCredentials:     "show_unlock_credentials",
+	GuiEventConnectProfiles:           "connect_profiles",
+	GuiEventChat:                      "chat",
+}
+
+// EventHub passes every GUI bus event on to control API subscribers.
+// A nil hub drops everything
+type EventHub struct {
+	sync.Mutex
+	subscribers map[chan Event]bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan Event]bool)}
+}
+
+// Subscribe returns a channel getting every event from now on. It is closed
+// on Unsubscribe, or once more than buffer events pile up unread
+func (hub *EventHub) Subscribe(buffer int) chan Event {
+	events := make(chan Event, buffer)
+	hub.Lock()
+	hub.subscribers[events] = true
+	hub.Unlock()
+	return events
+}
+
+func (hub *EventHub) Unsubscribe(events chan Event) {
+	hub.Lock()
+	defer hub.Unlock()
+	if hub.subscribers[events] {
+		delete(hub.subscribers, events)
+		close(events)
+	}
+}
+
+// Publish never blocks the GUI: subscribers who don't keep up are dropped
+func (hub *EventHub) Publish(event Event) {
+	if hub == nil {
+		return
+	}
+	hub.Lock()
+	defer hub.Unlock()
+	for events := range hub.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(hub.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Headless stands in for GuiHandle when there is no window: events only go
+// to control API subscribers, and prompts wait for an answer from there.
+// Saved networks are joined here like the window would.
+func Headless(state Andromeda) func() {
+	log := state.Log.With("headless")
+	return func() {
+		for request := range state.GuiBus {
+			state.Events.Publish(request)
+			// the rest only tell a window what to show, this one it acts on
+			if request.ID != GuiEventConnectProfiles {
+				continue
+			}
+			names := request.Event.(GuiReqConnectProfiles).Names
+			joins, locked, errs := state.profileJoins(names)
+			for _, err := range errs {
+				log.Error("Can't connect saved network", "error", err)
+			}
+			if locked {
+				log.Warn("Remembered passwords are locked, call unlock and then connect_profiles over the control socket", "profiles", names)
+				state.Events.Publish(Event{GuiEventShowUnlockCredentials, GuiReqShowUnlockCredentials{request}})
+				continue
+			}
+			for _, join := range joins {
+				join := join
+				go func() {
+					state.NetBus <- Event{
+						NetEventJoin,
+						join,
+					}
+				}()
+			}
+		}
+	}
+}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcFailed         = -32000
+)
+
+const controlSubscriberBuffer = 256
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // absent for notifications
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"` // for events sent to subscribers
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+// ControlEvent is what subscribers get for each GUI bus event
+type ControlEvent struct {
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// ControlSession is a user's session as the control API lists it
+type ControlSession struct {
+	Name    string
+	Role    Role
+	Remote  string
+	Since   time.Time
+	Pending int // packets queued to be written
+}
+
+// ControlHost is a network we host as the control API lists it
+type ControlHost struct {
+	ID       int
+	Name     string
+	Address  string
+	PubKey   []byte
+	Settings HostSettings
+}
+
+// ControlClient is a network we joined as the control API lists it
+type ControlClient struct {
+	ID        int
+	Profile   string
+	Server    string
+	Username  string
+	Role      Role
+	Connected bool // logged in or waiting on the host, false while the host key is unconfirmed
+}
+
+type ControlServer struct {
+	state    Andromeda
+	log      *Logger
+	path     string
+	listener net.Listener
+}
+
+// ServeControl listens on a Unix socket at path with the given file mode. The
+// socket is made in a private directory and only moved to path once its
+// mode is set, so it is never reachable with looser permissions
+func ServeControl(state Andromeda, path string, mode os.FileMode) (*ControlServer, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("another instance is listening on " + path)
+		}
+		os.Remove(path)
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".andromeda-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(private, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	server := &ControlServer{state, state.Log.With("control"), path, listener}
+	go server.accept()
+	return server, nil
+}
+
+// Close stops accepting connections and removes the socket
+func (server *ControlServer) Close() error {
+	err := server.listener.Close()
+	os.Remove(server.path)
+	return err
+}
+
+func (server *ControlServer) accept() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			server.log.Debug("Control socket closed", "error", err)
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	server.log.Debug("Control connection opened")
+	var lock sync.Mutex // guards encoder, events to subscribers come from elsewhere
+	encoder := json.NewEncoder(conn)
+	write := func(response rpcResponse) error {
+		response.JSONRPC = "2.0"
+		lock.Lock()
+		defer lock.Unlock()
+		return encoder.Encode(response)
+	}
+	var events chan Event
+	defer func() {
+		if events != nil {
+			server.state.Events.Unsubscribe(events)
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var request rpcRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			write(rpcResponse{ID: json.RawMessage("null"), Error: &rpcError{rpcParseError, err.Error()}})
+			continue
+		}
+		var result interface{}
+		var err error
+		if request.JSONRPC != "2.0" || request.Method == "" {
+			err = &rpcError{rpcInvalidRequest, "not a JSON-RPC 2.0 request"}
+		} else if request.Method == "subscribe" {
+			if events == nil && server.state.Events != nil {
+				events = server.state.Events.Subscribe(controlSubscriberBuffer)
+				go server.forward(conn, events, write)
+			} else if server.state.Events == nil {
+				err = &rpcError{rpcFailed, "events are not available"}
+			}
+		} else {
+			result, err = server.call(request.Method, request.Params)
+		}
+		server.log.Debug("Control call", "method", request.Method, "error", err)
+		if request.ID == nil {
+			continue
+		}
+		response := rpcResponse{ID: request.ID, Result: json.RawMessage("null")}
+		if err != nil {
+			rpcErr, ok := err.(*rpcError)
+			if !ok {
+				rpcErr = &rpcError{rpcFailed, err.Error()}
+			}
+			response.Result, response.Error = nil, rpcErr
+		} else if result != nil {
+			if response.Result, err = json.Marshal(result); err != nil {
+				response.Result, response.Error = nil, &rpcError{rpcFailed, err.Error()}
+			}
+		}
+		if write(response) != nil {
+			return
+		}
+	}
+	server.log.Debug("Control connection closed", "error", scanner.Err())
+}
+
+// forward sends events to a subscriber until it is dropped, then hangs up
+// on it so it knows it missed some
+func (server *ControlServer) forward(conn net.Conn, events chan Event, write func(rpcResponse) error) {
+	defer conn.Close()
+	for event := range events {
+		name := "unknown"
+		if event.ID >= 0 && event.ID < len(guiEventNames) {
+			name = guiEventNames[event.ID]
+		}
+		if write(rpcResponse{Method: "event", Params: ControlEvent{name, event.Event}}) != nil {
+			return
+		}
+	}
+}
+
+// call runs a method other than subscribe
+func (server *ControlServer) call(method string, params json.RawMessage) (interface{}, error) {
+	state := server.state
+	for id, name := range netEventNames {
+		if name != method {
+			continue
+		}
+		request := newNetRequest(id)
+		if err := decodeParams(params, request); err != nil {
+			return nil, err
+		}
+		// the bus carries NetReq values, not pointers
+		state.NetBus <- Event{id, reflect.ValueOf(request).Elem().Interface()}
+		return nil, nil
+	}
+
+	var target struct {
+		Host int
+	}
+	host := func() (*HostConfig, error) {
+		if err := decodeParams(params, &target); err != nil {
+			return nil, err
+		}
+		config := state.Hosts.Get(target.Host)
+		if config == nil {
+			return nil, &rpcError{rpcInvalidParams, fmt.Sprintf("no host %d", target.Host)}
+		}
+		return config, nil
+	}
+	switch method {
+	case "hosts":
+		hosts := []ControlHost{}
+		for _, config := range state.Hosts.List() {
+			hosts = append(hosts, ControlHost{config.ID, config.Name, config.bound, config.PubKey, config.Settings()})
+		}
+		return hosts, nil
+	case "users":
+		config, err := host()
+		if err != nil {
+			return nil, err
+		}
+		return append([]MemberInfo{}, config.Members()...), nil
+	case "sessions":
+		config, err := host()
+		if err != nil {
+			return nil, err
+		}
+		sessions := []ControlSession{}
+		config.Lock()
+		for _, user := range config.Users {
+			if session := user.Session; session != nil {
+				sessions = append(sessions, ControlSession{user.Name, user.Role, session.Remote, session.Started, session.Pending()})
+			}
+		}
+		config.Unlock()
+		return sessions, nil
+	case "registrations":
+		config, err := host()
+		if err != nil {
+			return nil, err
+		}
+		registrations := []MessageRegistrationRequest{}
+		for _, registration := range config.Registrations.List() {
+			registrations = append(registrations, registration.Message())
+		}
+		return registrations, nil
+	case "unlock":
+		var unlock struct {
+			Passphrase string
+		}
+		if err := decodeParams(params, &unlock); err != nil {
+			return nil, err
+		}
+		return nil, state.UnlockCredentials(unlock.Passphrase)
+	case "connect_profiles":
+		var connect GuiReqConnectProfiles
+		if err := decodeParams(params, &connect); err != nil {
+			return nil, err
+		}
+		state.GuiBus <- Event{GuiEventConnectProfiles, connect}
+		return nil, nil
+	case "clients":
+		clients := []ControlClient{}
+		for _, client := range state.Clients.List() {
+			client.Lock()
+			clients = append(clients, ControlClient{client.ID, client.Profile, client.Server, client.Username, client.Role, client.Queue != nil})
+			client.Unlock()
+		}
+		return clients, nil
+	}
+	return nil, &rpcError{rpcMethodNotFound, "no method '" + method + "'"}
+}
+
+func decodeParams(params json.RawMessage, into interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(into); err != nil {
+		return &rpcError{rpcInvalidParams, err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// controlClient speaks to a control socket the way a script would
+type controlClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+	next    int
+	events  []ControlEvent // received while waiting for responses
+}
+
+type controlReply struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func newControlNetwork(t *testing.T) (*testNetwork, *controlClient) {
+	t.Helper()
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Events = NewEventHub()
+	})
+	dir, err := ioutil.TempDir("", "andromeda-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	server, err := ServeControl(network.state, filepath.Join(dir, "control.sock"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return network, dialControl(t, filepath.Join(dir, "control.sock"))
+}
+
+func dialControl(t *testing.T, path string) *controlClient {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &controlClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+}
+
+func (client *controlClient) read() controlReply {
+	client.t.Helper()
+	client.conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+	if !client.scanner.Scan() {
+		client.t.Fatalf("control connection closed: %v", client.scanner.Err())
+	}
+	var reply controlReply
+	if err := json.Unmarshal(client.scanner.Bytes(), &reply); err != nil {
+		client.t.Fatalf("bad reply %s: %v", client.scanner.Bytes(), err)
+	}
+	return reply
+}
+
+// call sends a request and waits for its response, keeping events that
+// arrive in between
+func (client *controlClient) call(method string, params interface{}) controlReply {
+	client.t.Helper()
+	client.next++
+	request := map[string]interface{}{"jsonrpc": "2.0", "id": client.next, "method": method}
+	if params != nil {
+		request["params"] = params
+	}
+	if err := json.NewEncoder(client.conn).Encode(request); err != nil {
+		client.t.Fatal(err)
+	}
+	for {
+		reply := client.read()
+		if reply.Method == "event" {
+			var event ControlEvent
+			json.Unmarshal(reply.Params, &event)
+			client.events = append(client.events, event)
+			continue
+		}
+		if reply.ID == nil || *reply.ID != client.next {
+			client.t.Fatalf("reply to the wrong request: %+v", reply)
+		}
+		return reply
+	}
+}
+
+func (client *controlClient) result(method string, params interface{}, into interface{}) {
+	client.t.Helper()
+	reply := client.call(method, params)
+	if reply.Error != nil {
+		client.t.Fatalf("%s failed: %v", method, reply.Error.Message)
+	}
+	if into != nil {
+		if err := json.Unmarshal(reply.Result, into); err != nil {
+			client.t.Fatal(err)
+		}
+	}
+}
+
+// waitEvent waits for an event named name whose data matches
+func (client *controlClient) waitEvent(name string, match func(json.RawMessage) bool) {
+	client.t.Helper()
+	for {
+		for i, event := range client.events {
+			data, _ := json.Marshal(event.Data)
+			if event.Event == name && match(data) {
+				client.events = client.events[i+1:]
+				return
+			}
+		}
+		client.events = nil
+		reply := client.read()
+		if reply.Method == "event" {
+			var event ControlEvent
+			json.Unmarshal(reply.Params, &event)
+			client.events = append(client.events, event)
+		}
+	}
+}
+
+func TestControlSocketMode(t *testing.T) {
+	network, _ := newControlNetwork(t)
+	dir, err := ioutil.TempDir("", "andromeda-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "group.sock")
+	server, err := ServeControl(network.state, path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode is %v", info.Mode())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, ".andromeda-control*")); len(leftovers) != 0 {
+		t.Errorf("private directory left behind: %v", leftovers)
+	}
+
+	if _, err := ServeControl(network.state, path, 0600); err == nil {
+		t.Error("took over a socket another server is listening on")
+	}
+	server.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left behind after close: %v", err)
+	}
+
+	ioutil.WriteFile(path, []byte("data"), 0600)
+	if _, err := ServeControl(network.state, path, 0600); err == nil {
+		t.Error("replaced a regular file with the socket")
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	_, client := newControlNetwork(t)
+
+	if reply := client.call("no_such_method", nil); reply.Error == nil || reply.Error.Code != rpcMethodNotFound {
+		t.Errorf("unknown method answered %+v", reply)
+	}
+	if reply := client.call("users", map[string]int{"Host": 999}); reply.Error == nil || reply.Error.Code != rpcInvalidParams {
+		t.Errorf("unknown host answered %+v", reply)
+	}
+	if reply := client.call("kick", map[string]string{"Nonsense": "x"}); reply.Error == nil || reply.Error.Code != rpcInvalidParams {
+		t.Errorf("unknown param answered %+v", reply)
+	}
+
+	fmt.Fprintln(client.conn, "{not json")
+	if reply := client.read(); reply.Error == nil || reply.Error.Code != rpcParseError {
+		t.Errorf("malformed request answered %+v", reply)
+	}
+	// notifications don't get a response, the next call's does
+	fmt.Fprintln(client.conn, `{"jsonrpc":"2.0","method":"hosts"}`)
+	if reply := client.call("hosts", nil); reply.Error != nil {
+		t.Errorf("call after notification failed: %v", reply.Error.Message)
+	}
+}
+
+func TestControlHostsWhileStarting(t *testing.T) {
+	network, client := newControlNetwork(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			config, err := network.state.StartHost(fmt.Sprintf("other%d", i), "127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			network.state.StopHost(config)
+		}
+	}()
+	for {
+		var hosts []ControlHost
+		client.result("hosts", nil, &hosts)
+		for _, host := range hosts {
+			if host.Address == "" {
+				t.Errorf("host %s listed without an address", host.Name)
+			}
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestControlJoinAndChat(t *testing.T) {
+	network, client := newControlNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+
+	var hosts []ControlHost
+	client.result("hosts", nil, &hosts)
+	if len(hosts) != 1 || hosts[0].Name != "test" || hosts[0].Address != network.address() {
+		t.Fatalf("hosts listed as %+v", hosts)
+	}
+
+	client.result("subscribe", nil, nil)
+	client.result("join", NetReqJoin{Server: network.address(), Username: "alice", Password: "correct horse", Identity: "test-alice"}, nil)
+	client.waitEvent("show_verify", func(json.RawMessage) bool { return true })
+
+	var clients []ControlClient
+	client.result("clients", nil, &clients)
+	if len(clients) != 1 || clients[0].Username != "alice" || !clients[0].Connected {
+		t.Fatalf("clients listed as %+v", clients)
+	}
+	var sessions []ControlSession
+	client.result("sessions", map[string]int{"Host": hosts[0].ID}, &sessions)
+	if len(sessions) != 1 || sessions[0].Name != "alice" || sessions[0].Role != RoleMember {
+		t.Fatalf("sessions listed as %+v", sessions)
+	}
+	var users []MemberInfo
+	client.result("users", map[string]int{"Host": hosts[0].ID}, &users)
+	if len(users) != 1 || !users[0].Online {
+		t.Fatalf("users listed as %+v", users)
+	}
+
+	client.result("chat", NetReqChat{Client: clients[0].ID, Text: "hi from a script"}, nil)
+	client.waitEvent("chat", func(data json.RawMessage) bool {
+		var chat GuiReqChat
+		json.Unmarshal(data, &chat)
+		return chat.Host == hosts[0].ID && chat.From == "alice" && chat.Text == "hi from a script"
+	})
+
+	client.result("leave", NetReqLeave{clients[0].ID}, nil)
+	network.waitUntil("host to drop alice's session", func() bool {
+		return network.session("alice") == nil
+	})
+}
+
+func TestControlRegistration(t *testing.T) {
+	network, client := newControlNetwork(t)
+	network.host.RegistrationEnabled = true
+	client.result("subscribe", nil, nil)
+	network.join("carol", "hunter2")
+	network.waitUntil("registration request", func() bool {
+		return len(network.host.Registrations.List()) == 1
+	})
+
+	var registrations []MessageRegistrationRequest
+	client.result("registrations", map[string]int{"Host": network.host.ID}, &registrations)
+	if len(registrations) != 1 || registrations[0].Username != "carol" {
+		t.Fatalf("registrations listed as %+v", registrations)
+	}
+	client.result("registration", NetReqRegistration{network.host.ID, registrations[0].ID, true}, nil)
+	network.waitLoggedIn("carol")
+}
+
+// headless instances join their saved networks, once a script unlocked
+// the remembered passwords
+func TestHeadlessConnectsProfiles(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Events = NewEventHub()
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+	store := &CredentialStore{}
+	profiles := &Profiles{}
+	if err := store.Unlock(profiles, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := store.Seal("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles.Put(Profile{Name: "home", Server: network.address(), Username: "alice", Identity: "test-alice", AutoConnect: true, Password: sealed})
+	if err := network.state.SaveProfiles(profiles); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test network's own GUI bus answers join prompts, this one is headless
+	headless := network.state
+	headless.GuiBus = make(chan Event, 1)
+	go Headless(headless)()
+	t.Cleanup(func() { close(headless.GuiBus) })
+	dir, err := ioutil.TempDir("", "andromeda-control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	server, err := ServeControl(headless, filepath.Join(dir, "control.sock"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client := dialControl(t, filepath.Join(dir, "control.sock"))
+
+	client.result("subscribe", nil, nil)
+	headless.GuiBus <- Event{GuiEventConnectProfiles, GuiReqConnectProfiles{[]string{"home"}}}
+	client.waitEvent("show_unlock_credentials", func(json.RawMessage) bool { return true })
+	if reply := client.call("unlock", map[string]string{"Passphrase": "wrong"}); reply.Error == nil {
+		t.Error("unlocked with the wrong passphrase")
+	}
+	client.result("unlock", map[string]string{"Passphrase": "passphrase"}, nil)
+	client.result("connect_profiles", GuiReqConnectProfiles{[]string{"home"}}, nil)
+	network.waitLoggedIn("alice")
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	hub := NewEventHub()
+	events := hub.Subscribe(1)
+	hub.Publish(Event{GuiEventShowMain, GuiReqShowMain{}})
+	hub.Publish(Event{GuiEventShowMain, GuiReqShowMain{}})
+	<-events
+	if _, open := <-events; open {
+		t.Error("subscriber that fell behind was kept")
+	}
+	hub.Unsubscribe(events) // already dropped, must not close twice
+	var none *EventHub
+	none.Publish(Event{GuiEventShowMain, GuiReqShowMain{}})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Deadlines bound how long either end of a connection waits on the other,
+// so a peer that goes quiet doesn't hold a socket and goroutines forever
+type Deadlines struct {
+	Handshake time.Duration // to finish the key exchange
+	Auth      time.Duration // after that, until logged in or waiting for approval
+	Idle      time.Duration // without hearing from the peer once logged in
+	Keepalive time.Duration // between pings, a client's to not look idle and a host's to time round trips
+}
+
+var DefaultDeadlines = Deadlines{
+	Handshake: 10 * time.Second,
+	Auth:      time.Minute,
+	Idle:      90 * time.Second,
+	Keepalive: 30 * time.Second,
+}
+
+// setReadTimeout gives the peer timeout to send the next packet, 0 for forever
+func setReadTimeout(conn net.Conn, timeout time.Duration) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/sethvargo/go-diceware/diceware"
+)
+
+const (
+	dicewareWords       = 7776 // 6^5, one word per five dice rolls
+	fingerprintChecksum = 2    // trailing words catching typos, ~26 bits
+)
+
+var (
+	dicewareOnce    sync.Once
+	dicewareList    []string
+	dicewareIndexes map[string]int
+)
+
+// dicewareTable lists the EFF large wordlist by index 0..7775 rather than by
+// dice roll, along with the reverse mapping
+func dicewareTable() ([]string, map[string]int) {
+	dicewareOnce.Do(func() {
+		wordlist := diceware.WordListEffLarge()
+		dicewareList = make([]string, dicewareWords)
+		dicewareIndexes = make(map[string]int, dicewareWords)
+		for i := range dicewareList {
+			roll := 0
+			for n, digit := i, 0; digit < wordlist.Digits(); digit++ {
+				roll = roll*10 + n%6 + 1
+				n /= 6
+			}
+			dicewareList[i] = wordlist.WordAt(roll)
+			dicewareIndexes[dicewareList[i]] = i
+		}
+	})
+	return dicewareList, dicewareIndexes
+}
+
+// dicewareEncode writes value as count base-7776 words, most significant first
+func dicewareEncode(value *big.Int, count int) []string {
+	list, _ := dicewareTable()
+	value = new(big.Int).Set(value)
+	base := big.NewInt(dicewareWords)
+	index := new(big.Int)
+	words := make([]string, count)
+	for i := count - 1; i >= 0; i-- {
+		value.DivMod(value, base, index)
+		words[i] = list[index.Int64()]
+	}
+	return words
+}
+
+func fingerprintChecksumWords(data []byte) []string {
+	digest := sha256.Sum256(append([]byte("andromeda fingerprint v1"), data...))
+	return dicewareEncode(new(big.Int).SetBytes(digest[:8]), fingerprintChecksum)
+}
+
+// fingerprintDataWords is how many words it takes to hold a 0x01 marker byte
+// followed by n bytes; the marker keeps leading zero bytes from vanishing
+func fingerprintDataWords(n int) int {
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(8*(n+1)))
+	words := 0
+	for capacity := big.NewInt(1); capacity.Cmp(limit) < 0; words++ {
+		capacity.Mul(capacity, big.NewInt(dicewareWords))
+	}
+	return words
+}
+
+// EncodeFingerprint turns data into diceware words that DecodeFingerprint
+// maps back to exactly the same bytes
+func EncodeFingerprint(data []byte) []string {
+	value := new(big.Int).SetBytes(append([]byte{1}, data...))
+	words := dicewareEncode(value, fingerprintDataWords(len(data)))
+	return append(words, fingerprintChecksumWords(data)...)
+}
+
+func DecodeFingerprint(text string) ([]byte, error) {
+	_, indexes := dicewareTable()
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) <= fingerprintChecksum {
+		return nil, errors.New("fingerprint is too short")
+	}
+
+	value := new(big.Int)
+	base := big.NewInt(dicewareWords)
+	for i, word := range words[:len(words)-fingerprintChecksum] {
+		index, ok := indexes[word]
+		if !ok {
+			return nil, fmt.Errorf("unknown word '%s' at position %d", word, i+1)
+		}
+		value.Mul(value, base).Add(value, big.NewInt(int64(index)))
+	}
+	for i, word := range words[len(words)-fingerprintChecksum:] {
+		if _, ok := indexes[word]; !ok {
+			return nil, fmt.Errorf("unknown word '%s' at position %d", word, len(words)-fingerprintChecksum+i+1)
+		}
+	}
+
+	raw := value.Bytes()
+	if len(raw) == 0 || raw[0] != 1 || fingerprintDataWords(len(raw)-1) != len(words)-fingerprintChecksum {
+		return nil, errors.New("fingerprint is malformed, check for missing or extra words")
+	}
+	data := raw[1:]
+	checksum := strings.Join(fingerprintChecksumWords(data), " ")
+	if checksum != strings.Join(words[len(words)-fingerprintChecksum:], " ") {
+		return nil, errors.New("fingerprint checksum does not match, check for typos")
+	}
+	return data, nil
+}
+
+// FormatFingerprint lays the words of data out perLine to a line
+func FormatFingerprint(data []byte, perLine int) string {
+	words := EncodeFingerprint(data)
+	var lines []string
+	for len(words) > perLine {
+		lines = append(lines, strings.Join(words[:perLine], " "))
+		words = words[perLine:]
+	}
+	return strings.Join(append(lines, strings.Join(words, " ")), "\n")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFingerprintRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	inputs := [][]byte{
+		{},
+		{0},
+		{0, 0, 0, 1},
+		bytes.Repeat([]byte{0xff}, 32),
+		make([]byte, 32),
+	}
+	for i := 0; i < 100; i++ {
+		data := make([]byte, random.Intn(64))
+		random.Read(data)
+		inputs = append(inputs, data)
+	}
+
+	for _, data := range inputs {
+		words := EncodeFingerprint(data)
+		decoded, err := DecodeFingerprint(strings.Join(words, " "))
+		if err != nil {
+			t.Fatalf("decoding %x: %v", data, err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("round trip of %x gave %x", data, decoded)
+		}
+	}
+}
+
+func TestFingerprintKeyLength(t *testing.T) {
+	words := EncodeFingerprint(make([]byte, 32))
+	if len(words) != 21+fingerprintChecksum {
+		t.Errorf("32 byte key took %d words", len(words))
+	}
+}
+
+func TestFingerprintFormatting(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	formatted := FormatFingerprint(key, 4)
+	if lines := strings.Split(formatted, "\n"); len(lines) != 6 {
+		t.Errorf("expected 6 lines, got %d", len(lines))
+	}
+	decoded, err := DecodeFingerprint("  " + strings.ToUpper(formatted) + "\n")
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Errorf("formatted fingerprint did not decode: %v", err)
+	}
+}
+
+func TestFingerprintErrors(t *testing.T) {
+	list, _ := dicewareTable()
+	key := bytes.Repeat([]byte{7}, 32)
+	words := EncodeFingerprint(key)
+
+	typo := append([]string{}, words...)
+	if typo[3] == list[0] {
+		typo[3] = list[1]
+	} else {
+		typo[3] = list[0]
+	}
+	swapped := append([]string{}, words...)
+	swapped[4], swapped[5] = swapped[5], swapped[4]
+
+	for name, text := range map[string]string{
+		"empty":         "",
+		"too short":     words[0] + " " + words[1],
+		"unknown word":  strings.Join(append([]string{"notaword"}, words[1:]...), " "),
+		"missing word":  strings.Join(append(append([]string{}, words[:2]...), words[3:]...), " "),
+		"extra word":    strings.Join(append([]string{words[0]}, words...), " "),
+		"wrong word":    strings.Join(typo, " "),
+		"swapped words": strings.Join(swapped, " "),
+	} {
+		if _, err := DecodeFingerprint(text); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
+
+func TestShortAuthStringOrder(t *testing.T) {
+	host := bytes.Repeat([]byte{1}, 32)
+	client := bytes.Repeat([]byte{2}, 32)
+	hostNonce := bytes.Repeat([]byte{3}, sasNonceSize)
+	clientNonce := bytes.Repeat([]byte{4}, sasNonceSize)
+	words := ShortAuthString(host, client, hostNonce, clientNonce)
+	if len(words) != sasWordCount {
+		t.Fatalf("got %d words", len(words))
+	}
+	if strings.Join(words, " ") == strings.Join(ShortAuthString(client, host, hostNonce, clientNonce), " ") {
+		t.Error("swapping host and client keys gave the same words")
+	}
+	if strings.Join(words, " ") == strings.Join(ShortAuthString(host, client, hostNonce, hostNonce), " ") {
+		t.Error("the client's nonce does not change the words")
+	}
+}
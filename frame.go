@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+
+	"github.com/coderobe/securenet"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// securenet seals every Write as one frame, but its Read reports the sealed
+// length, box.Overhead more than it copied, and throws away whatever part of
+// a frame doesn't fit the buffer. That only works while reads happen to line
+// up with writes, so frameConn keeps frames small and reads them whole
+
+const maxFrame = 16 * 1024
+
+var errBadFrame = errors.New("frame length out of range")
+
+type frameConn struct {
+	securenet.Conn
+	reader *bufio.Reader
+}
+
+func newFrameConn(conn securenet.Conn) *frameConn {
+	return &frameConn{conn, bufio.NewReader(&frameReader{conn: conn, frame: make([]byte, maxFrame)})}
+}
+
+func (conn *frameConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *frameConn) ReadByte() (byte, error) {
+	return conn.reader.ReadByte()
+}
+
+func (conn *frameConn) UnreadByte() error {
+	return conn.reader.UnreadByte()
+}
+
+// Write splits p into frames the other end can read whole
+func (conn *frameConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + maxFrame
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := conn.Conn.Write(p[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// frameReader reads one frame at a time into a buffer big enough to hold it
+type frameReader struct {
+	conn   securenet.Conn
+	frame  []byte
+	unread []byte
+}
+
+func (reader *frameReader) Read(p []byte) (int, error) {
+	if len(reader.unread) == 0 {
+		n, err := reader.conn.Read(reader.frame)
+		if err != nil {
+			return 0, err
+		}
+		if n < box.Overhead || n-box.Overhead > len(reader.frame) {
+			return 0, errBadFrame
+		}
+		reader.unread = reader.frame[:n-box.Overhead]
+	}
+	n := copy(p, reader.unread)
+	reader.unread = reader.unread[n:]
+	return n, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coderobe/securenet"
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func encodeTestPacket(t testing.TB, packetID int, message interface{}) []byte {
+	var buffer bytes.Buffer
+	if err := boundSendMessage(&buffer)(packetID, message); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// addPacketSeeds seeds f with valid packets, alone and back to back
+func addPacketSeeds(f *testing.F) {
+	ping := encodeTestPacket(f, packetPing, MessagePing{"Foo, bar!"})
+	auth := encodeTestPacket(f, packetAuth, MessageAuth{Username: "alice", Nonce: bytes.Repeat([]byte{1}, scramNonceSize)})
+	authStatus := encodeTestPacket(f, packetAuthStatus, MessageAuthStatus{Success: true, ServerSignature: make([]byte, 32), Role: RoleAdmin})
+	proof := encodeTestPacket(f, packetAuthProof, MessageAuthProof{Proof: make([]byte, 32)})
+	setRole := encodeTestPacket(f, packetAdminSetRole, MessageAdminSetRole{"bob", RoleOwner})
+
+	f.Add(ping)
+	f.Add(auth)
+	f.Add(authStatus)
+	f.Add(proof)
+	f.Add(setRole)
+	f.Add(bytes.Join([][]byte{ping, auth, proof, ping}, nil))
+	f.Add(bytes.Join([][]byte{auth, authStatus, setRole}, nil))
+	f.Add(auth[:len(auth)/2])
+	f.Add([]byte{0xff})
+}
+
+func FuzzReadPacket(f *testing.F) {
+	addPacketSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bytes.NewReader(data)
+		decoder := msgpack.NewDecoder(reader)
+		for {
+			_, packet, err := readPacket(reader, decoder)
+			if err == io.EOF {
+				return
+			}
+			var packetErr *PacketError
+			if errors.As(err, &packetErr) {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			if packet == nil {
+				t.Fatal("no packet and no error")
+			}
+		}
+	})
+}
+
+// FuzzHostConnection feeds arbitrary bytes to the host over a real handshake
+// and requires it to hang up once they run out, without panicking
+func FuzzHostConnection(f *testing.F) {
+	addPacketSeeds(f)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer listener.Close()
+	hostPub, hostPriv, hostElligator, err := securenet.GenerateKeys()
+	if err != nil {
+		f.Fatal(err)
+	}
+	userPub, userPriv, userElligator, err := securenet.GenerateKeys()
+	if err != nil {
+		f.Fatal(err)
+	}
+	logger, err := NewLogger(LogConfig{Level: LogLevelError})
+	if err != nil {
+		f.Fatal(err)
+	}
+	state := Andromeda{
+		GuiBus: make(chan Event, 16),
+		Log:    logger,
+	}
+	go func() {
+		for range state.GuiBus {
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, verifier, err := ScramClientProof("password", randomBytes(scramSaltSize), scramMinIterations, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		audit, _ := OpenAuditLog("")
+		config := NewHostConfig("fuzz", HostSettings{AuthMode: AuthModePassword, MaxAuthFailures: 5}, audit)
+		config.Users = append(config.Users, &User{Name: "alice", Role: RoleAdmin, Verifier: verifier})
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}()
+		pConn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hostRaw, ok := <-accepted
+		if !ok {
+			t.Fatal("accept failed")
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			conn, err := securenet.WrapWithKeys(hostRaw, hostPub, hostPriv, hostElligator)
+			if err != nil {
+				hostRaw.Close()
+				return
+			}
+			handleHostConnection(state, config, state.Log, newFrameConn(conn))
+		}()
+		conn, err := securenet.WrapWithKeys(pConn, userPub, userPriv, userElligator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go io.Copy(ioutil.Discard, conn)
+		conn.Write(data)
+		conn.Close()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("host did not hang up after %d bytes of input", len(data))
+		}
+	})
+}
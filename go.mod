@@ -1,11 +1,12 @@
 module coderobe/andromeda
 
-go 1.14
+go 1.18
 
 require (
 	fyne.io/fyne v1.2.4
 	github.com/coderobe/securenet v0.0.0-20200429180608-6443cef849ee
 	github.com/sethvargo/go-diceware v0.2.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/vmihailenco/msgpack/v4 v4.3.11
 	golang.org/x/crypto v0.0.0-20200602180216-279210d13fed
 	robpike.io/filter v0.0.0-20150108201509-2984852a2183
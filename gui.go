@@ -1,34 +1,58 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/big"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"fyne.io/fyne"
 	"fyne.io/fyne/app"
+	"fyne.io/fyne/canvas"
+	"fyne.io/fyne/dialog"
 	"fyne.io/fyne/layout"
 	"fyne.io/fyne/theme"
 	"fyne.io/fyne/widget"
-	"github.com/sethvargo/go-diceware/diceware"
-	"robpike.io/filter"
+	"github.com/skip2/go-qrcode"
 )
 
+const auditViewLimit = 1000 // newest audit entries shown in the viewer
+
 const (
 	GuiEventShowMain = iota
 	GuiEventShowMessage
 	GuiEventShowHost
 	GuiEventShowHostReady
-	GuiEventShowHostUnknownConnection
+	GuiEventShowHostRegistrations
 	GuiEventShowJoin
 	GuiEventShowJoinUnknownConnection
 	GuiEventShowJoinOurHostKey
+	GuiEventShowLog
+	GuiEventShowIdentity
+	GuiEventShowAlert
+	GuiEventHostChanged
+	GuiEventShowHostInvites
+	GuiEventShowVerify
+	GuiEventShowSession
+	GuiEventSessionChanged
+	GuiEventShowAudit
+	GuiEventClientsChanged
+	GuiEventShowUnlockCredentials
+	GuiEventConnectProfiles
+	GuiEventChat
 )
 
 type GuiReqShowMain struct {
 }
+type GuiReqChat struct {
+	Host   int // network we host the message was sent on
+	Client int // network we joined it was sent on, instead of Host
+	From   string
+	Text   string
+}
 type GuiReqShowMessage struct {
 	Title   string
 	Content string
@@ -36,61 +60,160 @@ type GuiReqShowMessage struct {
 type GuiReqShowHost struct {
 }
 type GuiReqShowHostReady struct {
+	Host int
 }
-type GuiReqShowHostUnknownConnection struct {
-	PubKey   []byte
-	Username string
-	Password string
-	Send     interface{}
+type GuiReqShowHostRegistrations struct {
+	Host int
 }
 type GuiReqShowJoin struct {
+	Profile string // saved profile to edit, empty for a new connection
 }
 type GuiReqShowJoinUnknownConnection struct {
+	Client     int
+	KeyChanged bool // we pinned a different key for this server before
 }
 type GuiReqShowJoinOurHostKey struct {
+	Client int
+}
+type GuiReqShowLog struct {
+	Level LogLevel
+}
+type GuiReqShowAlert struct {
+	Title   string
+	Message string
+}
+type GuiReqHostChanged struct {
+	Host int // network whose users or registrations changed
+}
+type GuiReqShowHostInvites struct {
+	Host int
+}
+type GuiReqShowVerify struct {
+	Host     int    // network the user we verify is on, when we're hosting
+	Client   int    // network whose host we verify, when we're the client
+	Username string // user the host is verifying, empty when we're the client
+	Words    []string
+}
+type GuiReqShowSession struct {
+	Client int
+	Notice string
+}
+type GuiReqSessionChanged struct {
+	Client int
+}
+type GuiReqClientsChanged struct {
+}
+type GuiReqShowUnlockCredentials struct {
+	Then Event // sent once the credential store is unlocked
+}
+type GuiReqConnectProfiles struct {
+	Names []string
+}
+type GuiReqShowAudit struct {
+	Host   int
+	Filter AuditFilter
+}
+type GuiReqShowIdentity struct {
+	Name     string
+	Exported string
 }
 
 func GuiHandle(state Andromeda) func() {
 	channel := state.GuiBus
+	log := state.Log.With("gui")
 
 	gui := app.NewWithID("net.in.rob.andromeda")
 	win := gui.NewWindow("rob.in.net andromeda")
 	win.SetMaster()
+	screens := &Screens{state, channel, win, log}
 
 	go func() {
+		var current Event // screen to return to from the log viewer
 		for {
 			request := <-channel
-			fmt.Printf("Handling GUI event request %d\n", request.ID)
+			log.Debug("Handling GUI event request", "id", request.ID)
+			state.Events.Publish(request)
+			if request.ID != GuiEventShowLog && request.ID != GuiEventShowAlert && request.ID != GuiEventHostChanged &&
+				request.ID != GuiEventSessionChanged && request.ID != GuiEventClientsChanged && request.ID != GuiEventConnectProfiles &&
+				request.ID != GuiEventChat {
+				current = request
+			}
 			switch id := request.ID; id {
+			case GuiEventChat:
+				// there is no chat screen yet, it is only seen in the log and through the control API
+				chat := request.Event.(GuiReqChat)
+				log.Info("Chat", "host", chat.Host, "client", chat.Client, "from", chat.From, "text", chat.Text)
 			case GuiEventShowMain:
-				win.SetContent(widget.NewVBox(
-					widget.NewLabelWithStyle("Andromeda - A specific nebula", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
-					layout.NewSpacer(),
-					widget.NewHBox(
-						layout.NewSpacer(),
-						widget.NewHyperlink("code", parseURL("https://github.com/coderobe/andromeda")),
-						layout.NewSpacer(),
-					),
-					layout.NewSpacer(),
-					widget.NewLabelWithStyle("Create a network by selecting `Host` ...", fyne.TextAlignCenter, fyne.TextStyle{}),
-					widget.NewLabelWithStyle("...or join one with `Join`", fyne.TextAlignCenter, fyne.TextStyle{}),
-					layout.NewSpacer(),
-					fyne.NewContainerWithLayout(layout.NewGridLayout(2),
-						widget.NewButtonWithIcon("Host", theme.HomeIcon(), func() {
-							channel <- Event{
-								GuiEventShowHost,
-								GuiReqShowHost{},
-							}
-						}),
-						widget.NewButtonWithIcon("Join", theme.NavigateNextIcon(), func() {
-							channel <- Event{
-								GuiEventShowJoin,
-								GuiReqShowJoin{},
-							}
-						}),
-					),
-				))
+				win.SetContent(screens.Main())
 				win.CenterOnScreen()
+			case GuiEventClientsChanged:
+				if current.ID == GuiEventShowMain {
+					redraw := current
+					go func() {
+						channel <- redraw
+					}()
+				}
+			case GuiEventConnectProfiles:
+				joins, locked, errs := state.profileJoins(request.Event.(GuiReqConnectProfiles).Names)
+				for _, err := range errs {
+					dialog.ShowError(err, win)
+				}
+				if locked {
+					retry := request
+					go func() {
+						channel <- Event{
+							GuiEventShowUnlockCredentials,
+							GuiReqShowUnlockCredentials{retry},
+						}
+					}()
+					break
+				}
+				for _, join := range joins {
+					join := join
+					go func() {
+						state.NetBus <- Event{
+							NetEventJoin,
+							join,
+						}
+					}()
+				}
+			case GuiEventShowUnlockCredentials:
+				then := request.Event.(GuiReqShowUnlockCredentials).Then
+				passphrase := widget.NewPasswordEntry()
+				profiles, err := state.LoadProfiles()
+				if err != nil {
+					dialog.ShowError(err, win)
+					break
+				}
+				setup := profiles.CredentialSalt == nil
+				form := &widget.Form{
+					OnSubmit: func() {
+						if err := state.UnlockCredentials(passphrase.Text); err != nil {
+							dialog.ShowError(err, win)
+							return
+						}
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+						channel <- then
+					},
+					OnCancel: func() {
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+					},
+				}
+				form.Append("Passphrase", passphrase)
+				hint := "Enter your credential passphrase\nto use remembered passwords."
+				if setup {
+					hint = "Choose a passphrase to encrypt\nremembered passwords with."
+				}
+				win.SetContent(widget.NewGroup("Unlock credentials",
+					widget.NewLabelWithStyle(hint, fyne.TextAlignCenter, fyne.TextStyle{}),
+					form,
+				))
 			case GuiEventShowMessage:
 				win.SetContent(widget.NewGroup(
 					request.Event.(GuiReqShowMessage).Title,
@@ -101,214 +224,754 @@ func GuiHandle(state Andromeda) func() {
 					),
 				))
 			case GuiEventShowHost:
-				server := widget.NewEntry()
-				server.SetPlaceHolder("localhost:1234")
-				server.SetText("localhost:1234")
-
-				form := &widget.Form{
-					OnSubmit: func() {
+				win.SetContent(screens.Host())
+			case GuiEventShowHostReady:
+				config := state.Hosts.Get(request.Event.(GuiReqShowHostReady).Host)
+				if config == nil {
+					go func() {
 						channel <- Event{
-							GuiEventShowMessage,
-							GuiReqShowMessage{
-								"Host",
-								"Starting server...",
-							},
-						}
-						state.NetBus <- Event{
-							NetEventHost,
-							NetReqHost{
-								server.Text,
-							},
+							GuiEventShowMain,
+							GuiReqShowMain{},
 						}
-					},
-					OnCancel: func() {
+					}()
+					break
+				}
+				win.SetContent(screens.HostReady(config))
+			case GuiEventShowHostRegistrations:
+				config := state.Hosts.Get(request.Event.(GuiReqShowHostRegistrations).Host)
+				if config == nil {
+					go func() {
 						channel <- Event{
 							GuiEventShowMain,
 							GuiReqShowMain{},
 						}
-					},
+					}()
+					break
 				}
-				form.Append("Listen address:port", server)
-
-				win.SetContent(widget.NewGroup("Create network", form))
-			case GuiEventShowHostReady:
-				fmt.Println(state.OurPubKey)
-				fmt.Println(state.HostConfig.Users)
-				win.SetContent(widget.NewVBox(
-					widget.NewGroup("Accepting connections",
-						widget.NewVBox(
-							widget.NewLabelWithStyle("Your host is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
-							layout.NewSpacer(),
-							widget.NewLabelWithStyle(addNewlineEvery(4, bytesToDiceware(*state.OurPubKey)), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
-							layout.NewSpacer(),
-							widget.NewLabelWithStyle("Share this with your users.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+				cards := widget.NewVBox()
+				for _, registration := range config.Registrations.List() {
+					id := registration.ID
+					username := registration.Username
+					method := "password"
+					if registration.Verifier == nil {
+						method = "key only"
+					}
+					cards.Append(widget.NewGroup("'"+registration.Username+"'",
+						widget.NewLabelWithStyle(
+							fmt.Sprintf("From %s at %s (%s)\nExpires %s",
+								registration.Session.Remote,
+								registration.Time.Format("15:04:05"),
+								method,
+								registration.Expires().Format("15:04:05"),
+							),
+							fyne.TextAlignCenter,
+							fyne.TextStyle{},
 						),
-					),
-					layout.NewSpacer(),
-					widget.NewGroup("Configuration",
-						widget.NewHBox(
-							layout.NewSpacer(),
-							widget.NewCheck("Enable registration requests", func(b bool) {
-								state.HostConfig.RegistrationEnabled = b
+						widget.NewLabelWithStyle("The user is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+						widget.NewLabelWithStyle(FormatFingerprint(registration.PubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+						fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+							widget.NewButton("Deny", func() {
+								log.Info("Disallowed registration", "user", username)
+								state.NetBus <- Event{
+									NetEventRegistration,
+									NetReqRegistration{config.ID, id, false},
+								}
+							}),
+							widget.NewButton("Allow", func() {
+								log.Info("Allowed registration", "user", username)
+								state.NetBus <- Event{
+									NetEventRegistration,
+									NetReqRegistration{config.ID, id, true},
+								}
 							}),
-							layout.NewSpacer(),
 						),
+					))
+				}
+				if len(cards.Children) == 0 {
+					cards.Append(widget.NewLabelWithStyle("No pending registration requests", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+				}
+
+				back := widget.NewButtonWithIcon("Back", theme.NavigateBackIcon(), func() {
+					channel <- Event{
+						GuiEventShowHostReady,
+						GuiReqShowHostReady{config.ID},
+					}
+				})
+				win.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, back, nil, nil),
+					back,
+					widget.NewScrollContainer(cards),
+				))
+			case GuiEventShowHostInvites:
+				config := state.Hosts.Get(request.Event.(GuiReqShowHostInvites).Host)
+				if config == nil {
+					go func() {
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+					}()
+					break
+				}
+				settings := config.Settings()
+				address := widget.NewEntry()
+				address.SetPlaceHolder("listen address")
+				address.SetText(settings.PublicAddress)
+				inviteUsername := widget.NewEntry()
+				inviteUsername.SetPlaceHolder("any")
+				inviteRole := widget.NewSelect(roleNames, nil)
+				inviteRole.Selected = RoleMember.String()
+				inviteOneTime := widget.NewCheck("Single use", nil)
+				inviteOneTime.Checked = true
+				validity := map[string]time.Duration{
+					"1 hour": time.Hour,
+					"1 day":  24 * time.Hour,
+					"1 week": 7 * 24 * time.Hour,
+					"Never":  0,
+				}
+				inviteExpiry := widget.NewSelect([]string{"1 hour", "1 day", "1 week", "Never"}, nil)
+				inviteExpiry.Selected = "1 day"
+
+				createForm := &widget.Form{
+					OnSubmit: func() {
+						if address.Text != settings.PublicAddress {
+							if err := checkPublicAddress(address.Text); err != nil {
+								dialog.ShowError(err, win)
+								return
+							}
+							settings.PublicAddress = address.Text
+							state.NetBus <- Event{
+								NetEventSettings,
+								NetReqSettings{config.ID, settings},
+							}
+						}
+						role, _ := ParseRole(inviteRole.Selected)
+						invite := config.Invites.Create(inviteUsername.Text, role, inviteOneTime.Checked, validity[inviteExpiry.Selected])
+						log.Info("Created invite", "user", invite.Username, "role", invite.Role, "one_time", invite.OneTime, "expires", invite.Expires)
+						channel <- Event{
+							GuiEventShowHostInvites,
+							GuiReqShowHostInvites{config.ID},
+						}
+					},
+				}
+				createForm.Append("Public address", address)
+				createForm.Append("Username", inviteUsername)
+				createForm.Append("Role", inviteRole)
+				createForm.Append("", inviteOneTime)
+				createForm.Append("Valid for", inviteExpiry)
+
+				invites := widget.NewVBox()
+				joinAddress, err := config.JoinAddress()
+				if err != nil {
+					invites.Append(widget.NewLabelWithStyle(err.Error(), fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+				}
+				active := config.Invites.List()
+				for _, invite := range active {
+					code := invite.Code
+					link := JoinLink{joinAddress, config.PubKey, invite.Code}.String()
+					if joinAddress == "" {
+						link = "Code " + invite.Code
+					}
+					description := "For anyone"
+					if invite.Username != "" {
+						description = "For '" + invite.Username + "'"
+					}
+					description += ", " + invite.Role.String()
+					if invite.OneTime {
+						description += ", single use"
+					} else {
+						description += fmt.Sprintf(", used %d times", invite.Uses)
+					}
+					if !invite.Expires.IsZero() {
+						description += ", expires " + invite.Expires.Format("2006-01-02 15:04")
+					}
+					invites.Append(widget.NewGroup(description,
+						widget.NewLabelWithStyle(link, fyne.TextAlignLeading, fyne.TextStyle{Monospace: true}),
 						fyne.NewContainerWithLayout(layout.NewGridLayout(2),
-							widget.NewGroup("User Config",
-								widget.NewHBox(
-									layout.NewSpacer(),
-									widget.NewSelect(
-										filter.Apply(state.HostConfig.Users, func(u User) string {
-											return u.Name
-										}).([]string),
-										func(username string) {
-											fmt.Println("Selected", username) // todo handle
-										},
-									),
-									layout.NewSpacer(),
-								),
-							),
-							widget.NewGroup("Host Config",
-								widget.NewButton("Edit", func() {
-									fmt.Println("Host edit") // todo handle
-								}),
-							),
+							widget.NewButtonWithIcon("Copy", theme.ContentCopyIcon(), func() {
+								win.Clipboard().SetContent(link)
+							}),
+							widget.NewButtonWithIcon("Revoke", theme.DeleteIcon(), func() {
+								config.Invites.Revoke(code)
+								log.Info("Revoked invite")
+								channel <- Event{
+									GuiEventShowHostInvites,
+									GuiReqShowHostInvites{config.ID},
+								}
+							}),
 						),
+					))
+				}
+				if len(active) == 0 {
+					invites.Append(widget.NewLabelWithStyle("No active invites", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+				}
+
+				top := widget.NewGroup("New invite", createForm)
+				back := widget.NewButtonWithIcon("Back", theme.NavigateBackIcon(), func() {
+					channel <- Event{
+						GuiEventShowHostReady,
+						GuiReqShowHostReady{config.ID},
+					}
+				})
+				win.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(top, back, nil, nil),
+					top,
+					back,
+					widget.NewScrollContainer(invites),
+				))
+			case GuiEventHostChanged:
+				shown := 0 // host whose screen is up, IDs start at 1
+				switch screen := current.Event.(type) {
+				case GuiReqShowHostReady:
+					shown = screen.Host
+				case GuiReqShowHostRegistrations:
+					shown = screen.Host
+				case GuiReqShowHostInvites:
+					shown = screen.Host
+				}
+				if shown == request.Event.(GuiReqHostChanged).Host {
+					redraw := current
+					go func() {
+						channel <- redraw
+					}()
+				}
+			case GuiEventShowJoin:
+				win.SetContent(screens.Join(request.Event.(GuiReqShowJoin).Profile))
+			case GuiEventShowJoinUnknownConnection:
+				unknown := request.Event.(GuiReqShowJoinUnknownConnection)
+				client := state.Clients.Get(unknown.Client)
+				if client == nil {
+					break
+				}
+				win.SetContent(screens.JoinUnknownConnection(client, unknown.KeyChanged))
+			case GuiEventShowJoinOurHostKey:
+				client := state.Clients.Get(request.Event.(GuiReqShowJoinOurHostKey).Client)
+				if client == nil {
+					break
+				}
+				win.SetContent(screens.JoinOurHostKey(client))
+			case GuiEventShowLog:
+				level := request.Event.(GuiReqShowLog).Level
+				var lines []string
+				for _, entry := range state.Log.History(level) {
+					lines = append(lines, entry.Text())
+				}
+				text := strings.Join(lines, "\n")
+
+				levelSelect := widget.NewSelect(logLevelNames, func(name string) {
+					selected, err := ParseLogLevel(name)
+					if err != nil {
+						return
+					}
+					channel <- Event{
+						GuiEventShowLog,
+						GuiReqShowLog{selected},
+					}
+				})
+				levelSelect.Selected = level.String()
+				back := current
+
+				top := widget.NewHBox(
+					widget.NewLabel("Minimum level:"),
+					levelSelect,
+					layout.NewSpacer(),
+					widget.NewButtonWithIcon("Copy", theme.ContentCopyIcon(), func() {
+						win.Clipboard().SetContent(text)
+					}),
+					widget.NewButton("Refresh", func() {
+						channel <- Event{
+							GuiEventShowLog,
+							GuiReqShowLog{level},
+						}
+					}),
+				)
+				bottom := widget.NewButtonWithIcon("Back", theme.NavigateBackIcon(), func() {
+					channel <- back
+				})
+				win.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(top, bottom, nil, nil),
+					top,
+					bottom,
+					widget.NewScrollContainer(
+						widget.NewLabelWithStyle(text, fyne.TextAlignLeading, fyne.TextStyle{Monospace: true}),
 					),
 				))
-			case GuiEventShowHostUnknownConnection:
-				win.SetContent(widget.NewGroup("Unknown user connection",
+			case GuiEventShowAlert:
+				dialog.ShowInformation(
+					request.Event.(GuiReqShowAlert).Title,
+					request.Event.(GuiReqShowAlert).Message,
+					win,
+				)
+			case GuiEventShowVerify:
+				verify := request.Event.(GuiReqShowVerify)
+				peer := "the host"
+				if verify.Username != "" {
+					peer = "'" + verify.Username + "'"
+				}
+				answer := func(match bool) func() {
+					return func() {
+						state.NetBus <- Event{
+							NetEventVerify,
+							NetReqVerify{verify.Host, verify.Client, verify.Username, match},
+						}
+						if verify.Username != "" {
+							channel <- Event{
+								GuiEventShowHostReady,
+								GuiReqShowHostReady{verify.Host},
+							}
+						} else if match {
+							channel <- Event{
+								GuiEventShowSession,
+								GuiReqShowSession{verify.Client, "Host key verified"},
+							}
+						}
+					}
+				}
+				win.SetContent(widget.NewGroup("Verify connection",
 					widget.NewVBox(
-						widget.NewLabelWithStyle("A previously unknown user has connected", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle("Username: '"+request.Event.(GuiReqShowHostUnknownConnection).Username+"'", fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle("The user is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+						widget.NewLabelWithStyle("Read these words to "+peer+",\nfor example over a phone call:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
 						layout.NewSpacer(),
-						widget.NewLabelWithStyle(addNewlineEvery(4, bytesToDiceware(request.Event.(GuiReqShowHostUnknownConnection).PubKey)), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+						widget.NewLabelWithStyle(strings.Join(verify.Words, " "), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
 						layout.NewSpacer(),
+						widget.NewLabelWithStyle("If they see different words,\nyour connection might be intercepted.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+						fyne.NewContainerWithLayout(layout.NewGridLayout(3),
+							widget.NewButton("Words differ", answer(false)),
+							widget.NewButton("Skip", func() {
+								channel <- Event{
+									GuiEventShowSession,
+									GuiReqShowSession{verify.Client, "Host key not verified"},
+								}
+							}),
+							widget.NewButton("Words match", answer(true)),
+						),
+					),
+				))
+			case GuiEventShowSession:
+				client := state.Clients.Get(request.Event.(GuiReqShowSession).Client)
+				if client == nil {
+					go func() {
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+					}()
+					break
+				}
+				client.Lock()
+				role := client.Role
+				registrations := append([]MessageRegistrationRequest{}, client.Registrations...)
+				adminState := client.AdminState
+				client.Unlock()
 
-						widget.NewGroup("Allow registration?",
+				content := widget.NewVBox(
+					widget.NewLabelWithStyle(
+						fmt.Sprintf("Logged in to %s as '%s' (%s)", client.Server, client.Username, role),
+						fyne.TextAlignCenter,
+						fyne.TextStyle{Bold: true},
+					),
+					widget.NewLabelWithStyle(request.Event.(GuiReqShowSession).Notice, fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+				)
+				if role.Can(PermissionApproveRegistrations) {
+					cards := widget.NewVBox()
+					for _, registration := range registrations {
+						id := registration.ID
+						cards.Append(widget.NewGroup("'"+registration.Username+"'",
+							widget.NewLabelWithStyle(
+								fmt.Sprintf("From %s, expires %s", registration.Remote, registration.Expires.Format("15:04:05")),
+								fyne.TextAlignCenter,
+								fyne.TextStyle{},
+							),
+							widget.NewLabelWithStyle(FormatFingerprint(registration.PubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
 							fyne.NewContainerWithLayout(layout.NewGridLayout(2),
 								widget.NewButton("Deny", func() {
-									fmt.Println("Disallowed registration for", request.Event.(GuiReqShowHostUnknownConnection).Username)
 									state.NetBus <- Event{
-										NetEventRegistration,
-										NetReqRegistration{
-											request.Event.(GuiReqShowHostUnknownConnection).Username,
-											request.Event.(GuiReqShowHostUnknownConnection).Password,
-											false,
-											request.Event.(GuiReqShowHostUnknownConnection).Send,
-										},
+										NetEventRemoteRegistration,
+										NetReqRemoteRegistration{client.ID, id, false},
 									}
 								}),
 								widget.NewButton("Allow", func() {
-									fmt.Println("Allowed registration for", request.Event.(GuiReqShowHostUnknownConnection).Username)
 									state.NetBus <- Event{
-										NetEventRegistration,
-										NetReqRegistration{
-											request.Event.(GuiReqShowHostUnknownConnection).Username,
-											request.Event.(GuiReqShowHostUnknownConnection).Password,
-											true,
-											request.Event.(GuiReqShowHostUnknownConnection).Send,
-										},
+										NetEventRemoteRegistration,
+										NetReqRemoteRegistration{client.ID, id, true},
 									}
 								}),
 							),
-						),
-					),
-				))
-			case GuiEventShowJoin:
-				server := widget.NewEntry()
-				server.SetPlaceHolder("localhost:1234")
-				server.SetText("localhost:1234")
-				username := widget.NewEntry()
-				username.SetPlaceHolder("JohnDoe")
-				username.SetText("cdr") //todo remove
-				password := widget.NewPasswordEntry()
-				password.SetPlaceHolder("*******")
-				password.SetText("hunter2") //todo remove
+						))
+					}
+					if len(cards.Children) == 0 {
+						cards.Append(widget.NewLabelWithStyle("No pending registration requests", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+					}
+					content.Append(widget.NewGroup("Registration requests", cards))
+				}
+				if role.Can(PermissionKick) {
+					kickUsername := widget.NewEntry()
+					kickReason := widget.NewEntry()
+					kickReason.SetPlaceHolder("optional")
+					kickForm := &widget.Form{
+						OnSubmit: func() {
+							if kickUsername.Text == "" {
+								return
+							}
+							state.NetBus <- Event{
+								NetEventRemoteKick,
+								NetReqRemoteKick{client.ID, kickUsername.Text, kickReason.Text},
+							}
+							kickUsername.SetText("")
+							kickReason.SetText("")
+						},
+					}
+					kickForm.Append("Username", kickUsername)
+					kickForm.Append("Reason", kickReason)
+					content.Append(widget.NewGroup("Kick user", kickForm))
+				}
+				if role.Can(PermissionViewMembers) && adminState != nil {
+					members := widget.NewVBox()
+					for _, member := range adminState.Members {
+						name := member.Name
+						status := "offline"
+						if member.Online {
+							status = fmt.Sprintf("online from %s since %s", member.Remote, member.Since.Format("15:04"))
+						}
+						row := widget.NewHBox(widget.NewLabel(fmt.Sprintf("'%s' %s, %s", name, member.Role, status)), layout.NewSpacer())
+						if role.Can(PermissionManageRoles) && name != client.Username {
+							memberRole := widget.NewSelect(roleNames, nil)
+							memberRole.Selected = member.Role.String()
+							memberRole.OnChanged = func(selected string) {
+								if newRole, err := ParseRole(selected); err == nil {
+									state.NetBus <- Event{
+										NetEventRemoteRole,
+										NetReqRemoteRole{client.ID, name, newRole},
+									}
+								}
+							}
+							row.Append(memberRole)
+						}
+						if role.Can(PermissionKick) && member.Online && name != client.Username {
+							row.Append(widget.NewButton("Kick", func() {
+								state.NetBus <- Event{
+									NetEventRemoteKick,
+									NetReqRemoteKick{client.ID, name, ""},
+								}
+							}))
+						}
+						members.Append(row)
+					}
+					members.Append(widget.NewButtonWithIcon("Refresh", theme.ViewRefreshIcon(), func() {
+						state.NetBus <- Event{
+							NetEventRemoteQuery,
+							NetReqRemoteQuery{client.ID},
+						}
+					}))
+					content.Append(widget.NewGroup("Members", members))
+				}
+				if role.Can(PermissionConfigureHost) && adminState != nil {
+					settings := adminState.Settings
+					registrationCheck := widget.NewCheck("Enable registration requests", func(b bool) {
+						settings.RegistrationEnabled = b
+					})
+					registrationCheck.Checked = settings.RegistrationEnabled
+					keyAuthCheck := widget.NewCheck("Allow login by pinned key alone", func(b bool) {
+						if b {
+							settings.AuthMode = AuthModeKey
+						} else {
+							settings.AuthMode = AuthModePassword
+						}
+					})
+					keyAuthCheck.Checked = settings.AuthMode == AuthModeKey
+					adminsNeedBothCheck := widget.NewCheck("Admins need key and password", func(b bool) {
+						settings.AdminsNeedBoth = b
+					})
+					adminsNeedBothCheck.Checked = settings.AdminsNeedBoth
+					maxAuthFailures := widget.NewEntry()
+					maxAuthFailures.SetText(strconv.Itoa(settings.MaxAuthFailures))
+					publicAddress := widget.NewEntry()
+					publicAddress.SetPlaceHolder("listen address")
+					publicAddress.SetText(settings.PublicAddress)
 
-				form := &widget.Form{
-					OnSubmit: func() {
+					settingsForm := &widget.Form{
+						OnSubmit: func() {
+							failures, err := strconv.Atoi(maxAuthFailures.Text)
+							if err != nil {
+								dialog.ShowError(errors.New("Max failed logins must be a number"), win)
+								return
+							}
+							if err := checkPublicAddress(publicAddress.Text); err != nil {
+								dialog.ShowError(err, win)
+								return
+							}
+							settings.MaxAuthFailures = failures
+							settings.PublicAddress = publicAddress.Text
+							state.NetBus <- Event{
+								NetEventRemoteSettings,
+								NetReqRemoteSettings{client.ID, settings},
+							}
+						},
+					}
+					settingsForm.Append("", registrationCheck)
+					settingsForm.Append("", keyAuthCheck)
+					settingsForm.Append("", adminsNeedBothCheck)
+					settingsForm.Append("Max failed logins", maxAuthFailures)
+					settingsForm.Append("Public address", publicAddress)
+					content.Append(widget.NewGroup("Host settings", settingsForm))
+				}
+
+				bottom := fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+					widget.NewButtonWithIcon("Networks", theme.NavigateBackIcon(), func() {
 						channel <- Event{
-							GuiEventShowMessage,
-							GuiReqShowMessage{
-								"Join",
-								"Connecting to network...",
-							},
+							GuiEventShowMain,
+							GuiReqShowMain{},
 						}
+					}),
+					widget.NewButtonWithIcon("Disconnect", theme.CancelIcon(), func() {
 						state.NetBus <- Event{
-							NetEventJoin,
-							NetReqJoin{
-								server.Text,
-								username.Text,
-								password.Text,
-							},
+							NetEventLeave,
+							NetReqLeave{client.ID},
 						}
-					},
-					OnCancel: func() {
 						channel <- Event{
 							GuiEventShowMain,
 							GuiReqShowMain{},
 						}
-					},
+					}),
+				)
+				win.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, bottom, nil, nil),
+					bottom,
+					widget.NewScrollContainer(content),
+				))
+			case GuiEventShowAudit:
+				config := state.Hosts.Get(request.Event.(GuiReqShowAudit).Host)
+				if config == nil {
+					go func() {
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+					}()
+					break
+				}
+				filter := request.Event.(GuiReqShowAudit).Filter
+				var lines []string
+				for _, event := range config.Audit.Events(filter, auditViewLimit) {
+					line := fmt.Sprintf("%6d %s %-22s", event.Seq, event.Time.Local().Format("2006-01-02 15:04:05"), event.Kind)
+					if event.Username != "" {
+						line += " user=" + event.Username
+					}
+					if event.Actor != "" {
+						line += " by=" + event.Actor
+					}
+					if event.Remote != "" {
+						line += " remote=" + event.Remote
+					}
+					if len(event.Key) >= 16 {
+						line += " key=" + event.Key[:16]
+					}
+					if event.Detail != "" {
+						line += " " + event.Detail
+					}
+					lines = append(lines, line)
+				}
+				if len(lines) == 0 {
+					lines = append(lines, "No matching entries")
 				}
-				form.Append("Server", server)
-				form.Append("Username", username)
-				form.Append("Password", password)
 
-				win.SetContent(widget.NewGroup("Login", form))
-			case GuiEventShowJoinUnknownConnection:
-				win.SetContent(widget.NewGroup("Confirm network keys",
-					widget.NewVBox(
-						widget.NewLabelWithStyle("The host is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle(addNewlineEvery(4, bytesToDiceware(state.ClientConfig.TheirPubKey)), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle("If this is not the same key the host sees,\nyour connection might be intercepted.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
-						layout.NewSpacer(),
+				kinds := append([]string{"all"}, AuditKinds...)
+				kindSelect := widget.NewSelect(kinds, nil)
+				kindSelect.Selected = "all"
+				if filter.Kind != "" {
+					kindSelect.Selected = filter.Kind
+				}
+				search := widget.NewEntry()
+				search.SetPlaceHolder("user, address, key...")
+				search.SetText(filter.Text)
+				apply := func() {
+					kind := kindSelect.Selected
+					if kind == "all" {
+						kind = ""
+					}
+					channel <- Event{
+						GuiEventShowAudit,
+						GuiReqShowAudit{config.ID, AuditFilter{kind, search.Text}},
+					}
+				}
+				kindSelect.OnChanged = func(string) { apply() }
 
-						widget.NewGroup("Continue connecting?",
-							fyne.NewContainerWithLayout(layout.NewGridLayout(2),
-								widget.NewButton("Abort", func() {
-									fmt.Println("Cancelling connection")
-									state.NetBus <- Event{
-										NetEventJoinUnknownConnection,
-										NetReqJoinUnknownConnection{false},
-									}
-								}),
-								widget.NewButton("Continue", func() {
-									fmt.Println("Continuing connection")
-									state.NetBus <- Event{
-										NetEventJoinUnknownConnection,
-										NetReqJoinUnknownConnection{true},
-									}
-								}),
-							),
-						),
+				integrity := "Hash chain intact"
+				if broken := config.Audit.Verify(); broken != 0 {
+					integrity = fmt.Sprintf("TAMPERED: hash chain breaks at entry %d", broken)
+				}
+				exportPath := widget.NewEntry()
+				if path, err := state.networkPath(config.Name, "audit-export.jsonl"); err == nil {
+					exportPath.SetText(path)
+				}
+
+				top := widget.NewVBox(
+					widget.NewHBox(
+						widget.NewLabel("Kind:"),
+						kindSelect,
+						widget.NewLabel("Search:"),
+						fyne.NewContainerWithLayout(layout.NewFixedGridLayout(fyne.NewSize(200, search.MinSize().Height)), search),
+						widget.NewButton("Filter", apply),
+						layout.NewSpacer(),
+						widget.NewLabelWithStyle(integrity, fyne.TextAlignTrailing, fyne.TextStyle{Bold: true}),
+					),
+					exportPath,
+					widget.NewButtonWithIcon("Export as JSON lines", theme.DocumentSaveIcon(), func() {
+						file, err := os.OpenFile(exportPath.Text, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+						if err == nil {
+							err = config.Audit.Export(file, filter)
+							if closeErr := file.Close(); err == nil {
+								err = closeErr
+							}
+						}
+						if err != nil {
+							dialog.ShowError(err, win)
+							return
+						}
+						log.Info("Exported audit log", "path", exportPath.Text, "kind", filter.Kind, "search", filter.Text)
+						dialog.ShowInformation("Audit log", "Exported to "+exportPath.Text, win)
+					}),
+				)
+				back := widget.NewButtonWithIcon("Back", theme.NavigateBackIcon(), func() {
+					channel <- Event{
+						GuiEventShowHostReady,
+						GuiReqShowHostReady{config.ID},
+					}
+				})
+				win.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(top, back, nil, nil),
+					top,
+					back,
+					widget.NewScrollContainer(
+						widget.NewLabelWithStyle(strings.Join(lines, "\n"), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true}),
 					),
 				))
-			case GuiEventShowJoinOurHostKey:
-				win.SetContent(widget.NewGroup("Confirm network keys",
-					widget.NewVBox(
-						widget.NewLabelWithStyle("Your client is identifying as:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle(addNewlineEvery(4, bytesToDiceware(*state.OurPubKey)), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
-						layout.NewSpacer(),
-						widget.NewLabelWithStyle("Please share this with your host\nto verify your connection.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+			case GuiEventSessionChanged:
+				if current.ID == GuiEventShowSession && current.Event.(GuiReqShowSession).Client == request.Event.(GuiReqSessionChanged).Client {
+					redraw := current
+					go func() {
+						channel <- redraw
+					}()
+				}
+			case GuiEventShowIdentity:
+				name := request.Event.(GuiReqShowIdentity).Name
+				identity, err := state.LoadIdentity(name)
+				if err != nil {
+					log.Error("Can't load identity", "identity", name, "error", err)
+					dialog.ShowError(err, win)
+					identity = &Identity{}
+				}
+				names, err := state.ListIdentities()
+				if err != nil {
+					log.Error("Can't list identities", "error", err)
+				}
+
+				identitySelect := widget.NewSelect(names, func(selected string) {
+					channel <- Event{
+						GuiEventShowIdentity,
+						GuiReqShowIdentity{selected, ""},
+					}
+				})
+				identitySelect.Selected = name
+
+				exportPassphrase := widget.NewPasswordEntry()
+				exportPassphrase.SetPlaceHolder("passphrase protecting the export")
+				exported := widget.NewMultiLineEntry()
+				exported.SetText(request.Event.(GuiReqShowIdentity).Exported)
+				exportForm := &widget.Form{
+					OnSubmit: func() {
+						text, err := identity.Export(exportPassphrase.Text)
+						if err != nil {
+							dialog.ShowError(err, win)
+							return
+						}
+						log.Info("Exported identity", "identity", name)
+						channel <- Event{
+							GuiEventShowIdentity,
+							GuiReqShowIdentity{name, text},
+						}
+					},
+				}
+				exportForm.Append("Passphrase", exportPassphrase)
+
+				importName := widget.NewEntry()
+				importName.SetPlaceHolder(DefaultIdentity)
+				importText := widget.NewMultiLineEntry()
+				importText.SetPlaceHolder(identityExportPrefix + "...")
+				importPassphrase := widget.NewPasswordEntry()
+				importReplace := widget.NewCheck("Replace an existing identity", nil)
+				importForm := &widget.Form{
+					OnSubmit: func() {
+						target := importName.Text
+						if target == "" {
+							target = DefaultIdentity
+						}
+						imported, err := ImportIdentity(importText.Text, importPassphrase.Text)
+						if err != nil {
+							dialog.ShowError(err, win)
+							return
+						}
+						if path, err := state.identityPath(target); err != nil {
+							dialog.ShowError(err, win)
+							return
+						} else if _, err := os.Stat(path); err == nil && !importReplace.Checked {
+							dialog.ShowError(errors.New("identity '"+target+"' already exists"), win)
+							return
+						}
+						if err := state.SaveIdentity(target, imported); err != nil {
+							dialog.ShowError(err, win)
+							return
+						}
+						log.Info("Imported identity", "identity", target)
+						channel <- Event{
+							GuiEventShowIdentity,
+							GuiReqShowIdentity{target, ""},
+						}
+					},
+				}
+				importForm.Append("Name", importName)
+				importForm.Append("Exported identity", importText)
+				importForm.Append("Passphrase", importPassphrase)
+				importForm.Append("", importReplace)
+
+				win.SetContent(widget.NewVBox(
+					widget.NewGroup("Identity",
+						identitySelect,
+						widget.NewLabelWithStyle("Hosts recognise this device by:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+						widget.NewLabelWithStyle(FormatFingerprint(identity.PubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+					),
+					widget.NewGroup("Export",
+						exportForm,
+						exported,
+						widget.NewButtonWithIcon("Copy", theme.ContentCopyIcon(), func() {
+							win.Clipboard().SetContent(exported.Text)
+						}),
 					),
+					widget.NewGroup("Import", importForm),
+					widget.NewButtonWithIcon("Back", theme.NavigateBackIcon(), func() {
+						channel <- Event{
+							GuiEventShowMain,
+							GuiReqShowMain{},
+						}
+					}),
 				))
 			default:
-				fmt.Printf("Fatal: Unknown GUI event %d, this should not have happened\n", id)
+				log.Error("Fatal: Unknown GUI event, this should not have happened", "id", id)
 				os.Exit(1)
 			}
 		}
 	}()
 	return func() {
 		win.ShowAndRun()
-		fmt.Println("GuiHandle stopped")
+		log.Info("GuiHandle stopped")
+	}
+}
+
+// qrCode renders content as a QR code of size pixels
+func qrCode(content string, size int) fyne.CanvasObject {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		fyne.LogError("Could not encode QR code", err)
+		return layout.NewSpacer()
 	}
+	image := canvas.NewImageFromImage(code.Image(size))
+	image.FillMode = canvas.ImageFillContain
+	image.SetMinSize(fyne.NewSize(size, size))
+	return image
 }
 
 func parseURL(urlStr string) *url.URL {
@@ -319,47 +982,3 @@ func parseURL(urlStr string) *url.URL {
 
 	return link
 }
-
-func addNewlineEvery(n int, input string) (output string) {
-	words := strings.Split(input, " ")
-	output = ""
-	for i, k := range words {
-		output += k
-		if (i+1)%n == 0 {
-			output += "\n"
-		} else {
-			output += " "
-		}
-	}
-	return
-}
-
-func bytesToDiceware(in []byte) (output string) {
-	wordlist := diceware.WordListEffLarge()
-	digits := wordlist.Digits()
-	input := big.NewInt(0)
-	input.SetBytes(in)
-
-	outword := 0
-	outlen := digits
-	for _, c := range input.Text(6) {
-		if outlen > 0 {
-			outword = outword*10 + (int(c) - 47)
-			outlen--
-		} else {
-			outlen = digits
-			output += " "
-			output += wordlist.WordAt(outword)
-			outword = 0
-		}
-	}
-	if outlen > 0 {
-		for outlen > 0 {
-			outword = outword*10 + 1
-			outlen--
-		}
-		output += " "
-		output += wordlist.WordAt(outword)
-	}
-	return output[1:]
-}
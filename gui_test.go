@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/test"
+	"fyne.io/fyne/widget"
+)
+
+// newTestScreens renders screens in fyne's headless test app, with buffered
+// buses standing in for the GUI and network loops
+func newTestScreens(t *testing.T) *Screens {
+	dir, err := ioutil.TempDir("", "andromeda-gui-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	logger, err := NewLogger(LogConfig{Level: LogLevelWarn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.NewApp()
+	state := Andromeda{
+		GuiBus:       make(chan Event, 16),
+		NetBus:       make(chan Event, 16),
+		Hosts:        NewHostSet(),
+		HostDefaults: HostSettings{AuthMode: AuthModePassword, MaxAuthFailures: 5},
+		Clients:      NewClientSet(),
+		Credentials:  &CredentialStore{},
+		Log:          logger,
+		ConfigDir:    dir,
+	}
+	return &Screens{state, state.GuiBus, test.NewWindow(nil), logger.With("gui")}
+}
+
+// walk visits object and everything rendered inside it, depth first
+func walk(object fyne.CanvasObject, visit func(fyne.CanvasObject)) {
+	visit(object)
+	switch object := object.(type) {
+	case *fyne.Container:
+		for _, child := range object.Objects {
+			walk(child, visit)
+		}
+	case fyne.Widget:
+		for _, child := range widget.Renderer(object).Objects() {
+			walk(child, visit)
+		}
+	}
+}
+
+func findButton(t *testing.T, content fyne.CanvasObject, text string) *widget.Button {
+	t.Helper()
+	var found *widget.Button
+	walk(content, func(object fyne.CanvasObject) {
+		if button, ok := object.(*widget.Button); ok && found == nil && button.Text == text {
+			found = button
+		}
+	})
+	if found == nil {
+		t.Fatalf("no button '%s' on screen", text)
+	}
+	return found
+}
+
+func findCheck(t *testing.T, content fyne.CanvasObject, text string) *widget.Check {
+	t.Helper()
+	var found *widget.Check
+	walk(content, func(object fyne.CanvasObject) {
+		if check, ok := object.(*widget.Check); ok && found == nil && check.Text == text {
+			found = check
+		}
+	})
+	if found == nil {
+		t.Fatalf("no check '%s' on screen", text)
+	}
+	return found
+}
+
+func findEntry(t *testing.T, content fyne.CanvasObject, placeHolder string) *widget.Entry {
+	t.Helper()
+	var found *widget.Entry
+	walk(content, func(object fyne.CanvasObject) {
+		if entry, ok := object.(*widget.Entry); ok && found == nil && entry.PlaceHolder == placeHolder {
+			found = entry
+		}
+	})
+	if found == nil {
+		t.Fatalf("no entry '%s' on screen", placeHolder)
+	}
+	return found
+}
+
+// findSelect returns the select offering option
+func findSelect(t *testing.T, content fyne.CanvasObject, option string) *widget.Select {
+	t.Helper()
+	var found *widget.Select
+	walk(content, func(object fyne.CanvasObject) {
+		if list, ok := object.(*widget.Select); ok && found == nil {
+			for _, o := range list.Options {
+				if o == option {
+					found = list
+				}
+			}
+		}
+	})
+	if found == nil {
+		t.Fatalf("no select offering '%s' on screen", option)
+	}
+	return found
+}
+
+func findForm(t *testing.T, content fyne.CanvasObject) *widget.Form {
+	t.Helper()
+	var found *widget.Form
+	walk(content, func(object fyne.CanvasObject) {
+		if form, ok := object.(*widget.Form); ok && found == nil {
+			found = form
+		}
+	})
+	if found == nil {
+		t.Fatal("no form on screen")
+	}
+	return found
+}
+
+func hasLabel(content fyne.CanvasObject, text string) bool {
+	found := false
+	walk(content, func(object fyne.CanvasObject) {
+		if label, ok := object.(*widget.Label); ok && strings.Contains(label.Text, text) {
+			found = true
+		}
+	})
+	return found
+}
+
+// expectEvent takes the next event off bus, which has to be of kind id;
+// callbacks send synchronously, so it is already queued once a tap returns
+func expectEvent(t *testing.T, bus chan Event, id int) interface{} {
+	t.Helper()
+	select {
+	case event := <-bus:
+		if event.ID != id {
+			t.Fatalf("got event %d (%+v), want %d", event.ID, event.Event, id)
+		}
+		return event.Event
+	default:
+		t.Fatalf("no event sent, want %d", id)
+	}
+	return nil
+}
+
+func expectNoEvent(t *testing.T, bus chan Event) {
+	t.Helper()
+	select {
+	case event := <-bus:
+		t.Fatalf("unexpected event %d (%+v)", event.ID, event.Event)
+	default:
+	}
+}
+
+func testHost(t *testing.T, screens *Screens, name string) *HostConfig {
+	audit, _ := OpenAuditLog("")
+	config := NewHostConfig(name, screens.state.HostDefaults, audit)
+	config.Address = "127.0.0.1:1234"
+	config.PubKey = bytes.Repeat([]byte{7}, 32)
+	if _, err := screens.state.Hosts.Add(config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func testClient(screens *Screens, username string) *ClientConfig {
+	client := &ClientConfig{
+		Server:      "example.org:1234",
+		Username:    username,
+		OurPubKey:   bytes.Repeat([]byte{1}, 32),
+		TheirPubKey: bytes.Repeat([]byte{2}, 32),
+	}
+	screens.state.Clients.Add(client)
+	return client
+}
+
+func TestMainScreenButtons(t *testing.T) {
+	screens := newTestScreens(t)
+	host := testHost(t, screens, "lan")
+	client := testClient(screens, "alice")
+	content := screens.Main()
+
+	test.Tap(findButton(t, content, "Host"))
+	expectEvent(t, screens.state.GuiBus, GuiEventShowHost)
+	test.Tap(findButton(t, content, "Join"))
+	if request := expectEvent(t, screens.state.GuiBus, GuiEventShowJoin).(GuiReqShowJoin); request.Profile != "" {
+		t.Errorf("join opened profile '%s', want a blank form", request.Profile)
+	}
+
+	test.Tap(findButton(t, content, "Stop"))
+	if request := expectEvent(t, screens.state.NetBus, NetEventStopHost).(NetReqStopHost); request.Host != host.ID {
+		t.Errorf("stop sent host %d, want %d", request.Host, host.ID)
+	}
+	test.Tap(findButton(t, content, "Leave"))
+	if request := expectEvent(t, screens.state.NetBus, NetEventLeave).(NetReqLeave); request.Client != client.ID {
+		t.Errorf("leave sent client %d, want %d", request.Client, client.ID)
+	}
+}
+
+func TestMainScreenProfiles(t *testing.T) {
+	screens := newTestScreens(t)
+	profiles := &Profiles{}
+	profiles.Put(Profile{Name: "work", Server: "example.org:1234", Username: "alice"})
+	if err := screens.state.SaveProfiles(profiles); err != nil {
+		t.Fatal(err)
+	}
+	content := screens.Main()
+
+	test.Tap(findButton(t, content, "Connect"))
+	request := expectEvent(t, screens.state.GuiBus, GuiEventConnectProfiles).(GuiReqConnectProfiles)
+	if len(request.Names) != 1 || request.Names[0] != "work" {
+		t.Errorf("connect sent profiles %v, want [work]", request.Names)
+	}
+	test.Tap(findButton(t, content, "Edit"))
+	if request := expectEvent(t, screens.state.GuiBus, GuiEventShowJoin).(GuiReqShowJoin); request.Profile != "work" {
+		t.Errorf("edit opened profile '%s', want work", request.Profile)
+	}
+}
+
+func TestHostForm(t *testing.T) {
+	screens := newTestScreens(t)
+	content := screens.Host()
+
+	findEntry(t, content, "default").SetText("lan")
+	findEntry(t, content, "localhost:1234").SetText("0.0.0.0:4321")
+	findForm(t, content).OnSubmit()
+
+	expectEvent(t, screens.state.GuiBus, GuiEventShowMessage)
+	request := expectEvent(t, screens.state.NetBus, NetEventHost).(NetReqHost)
+	if request.Name != "lan" || request.Server != "0.0.0.0:4321" {
+		t.Errorf("host form sent %+v", request)
+	}
+}
+
+func TestHostReadyUserControls(t *testing.T) {
+	screens := newTestScreens(t)
+	host := testHost(t, screens, "lan")
+	host.Users = append(host.Users, &User{Name: "alice", Role: RoleMember})
+	content := screens.HostReady(host)
+
+	if !hasLabel(content, FormatFingerprint(host.PubKey, 4)) {
+		t.Error("host key fingerprint is not shown")
+	}
+	if !hasLabel(content, errLoopbackJoinAddress.Error()) {
+		t.Error("no warning that the join link only works on this machine")
+	}
+
+	// nothing to kick before a user is picked
+	test.Tap(findButton(t, content, "Kick"))
+	expectNoEvent(t, screens.state.NetBus)
+
+	findSelect(t, content, "alice").SetSelected("alice")
+	expectNoEvent(t, screens.state.NetBus)
+
+	findSelect(t, content, RoleAdmin.String()).SetSelected(RoleAdmin.String())
+	role := expectEvent(t, screens.state.NetBus, NetEventSetRole).(NetReqSetRole)
+	if role != (NetReqSetRole{host.ID, "alice", RoleAdmin}) {
+		t.Errorf("role change sent %+v", role)
+	}
+
+	test.Tap(findButton(t, content, "Kick"))
+	kick := expectEvent(t, screens.state.NetBus, NetEventKick).(NetReqKick)
+	if kick != (NetReqKick{host.ID, "alice", ""}) {
+		t.Errorf("kick sent %+v", kick)
+	}
+
+	// settings go through the net handler, which audits them
+	findCheck(t, content, "Enable registration requests").SetChecked(true)
+	findCheck(t, content, "Admins need key and password").SetChecked(true)
+	expectEvent(t, screens.state.NetBus, NetEventSettings)
+	settings := expectEvent(t, screens.state.NetBus, NetEventSettings).(NetReqSettings)
+	if settings.Host != host.ID || !settings.Settings.RegistrationEnabled || !settings.Settings.AdminsNeedBoth {
+		t.Errorf("settings sent %+v", settings)
+	}
+	if host.Settings().AdminsNeedBoth {
+		t.Error("screen changed settings itself")
+	}
+}
+
+func TestJoinUnknownConnection(t *testing.T) {
+	for _, c := range []struct {
+		button string
+		allow  bool
+	}{
+		{"Continue", true},
+		{"Abort", false},
+	} {
+		screens := newTestScreens(t)
+		client := testClient(screens, "alice")
+		content := screens.JoinUnknownConnection(client, false)
+
+		if !hasLabel(content, FormatFingerprint(client.TheirPubKey, 4)) {
+			t.Error("host key fingerprint is not shown")
+		}
+		test.Tap(findButton(t, content, c.button))
+		request := expectEvent(t, screens.state.NetBus, NetEventJoinUnknownConnection).(NetReqJoinUnknownConnection)
+		if request != (NetReqJoinUnknownConnection{client.ID, c.allow}) {
+			t.Errorf("%s sent %+v", c.button, request)
+		}
+	}
+}
+
+func TestJoinUnknownConnectionKeyChanged(t *testing.T) {
+	screens := newTestScreens(t)
+	client := testClient(screens, "alice")
+
+	if hasLabel(screens.JoinUnknownConnection(client, false), "WARNING") {
+		t.Error("warned about a key that did not change")
+	}
+	if !hasLabel(screens.JoinUnknownConnection(client, true), "WARNING") {
+		t.Error("no warning for a changed host key")
+	}
+}
+
+func TestJoinForm(t *testing.T) {
+	screens := newTestScreens(t)
+	content := screens.Join("")
+
+	test.Type(findEntry(t, content, "example.org:1234"), "example.org:1234")
+	test.Type(findEntry(t, content, "JohnDoe"), "alice")
+	test.Type(findEntry(t, content, "empty to log in by key"), "hunter2")
+	findForm(t, content).OnSubmit()
+
+	expectEvent(t, screens.state.GuiBus, GuiEventShowMessage)
+	request := expectEvent(t, screens.state.NetBus, NetEventJoin).(NetReqJoin)
+	if request.Profile != "" || request.Server != "example.org:1234" || request.Username != "alice" ||
+		request.Password != "hunter2" || request.Identity != DefaultIdentity || request.HostKey != nil || request.Invite != "" {
+		t.Errorf("join form sent %+v", request)
+	}
+}
+
+func TestJoinFormRequiresServer(t *testing.T) {
+	screens := newTestScreens(t)
+	content := screens.Join("")
+
+	test.Type(findEntry(t, content, "JohnDoe"), "alice")
+	findForm(t, content).OnSubmit()
+	expectNoEvent(t, screens.state.NetBus)
+}
+
+func TestJoinFormLink(t *testing.T) {
+	screens := newTestScreens(t)
+	content := screens.Join("")
+	key := bytes.Repeat([]byte{9}, 32)
+
+	test.Type(findEntry(t, content, "andromeda://... (optional)"), JoinLink{"example.org:1234", key, "invite"}.String())
+	server := findEntry(t, content, "example.org:1234")
+	if server.Text != "example.org:1234" {
+		t.Fatalf("join link filled in server '%s'", server.Text)
+	}
+	test.Type(findEntry(t, content, "JohnDoe"), "alice")
+	findForm(t, content).OnSubmit()
+
+	expectEvent(t, screens.state.GuiBus, GuiEventShowMessage)
+	request := expectEvent(t, screens.state.NetBus, NetEventJoin).(NetReqJoin)
+	if !bytes.Equal(request.HostKey, key) || request.Invite != "invite" {
+		t.Errorf("join link was not applied: %+v", request)
+	}
+}
+
+func TestJoinFormSavesProfile(t *testing.T) {
+	screens := newTestScreens(t)
+	content := screens.Join("")
+
+	test.Type(findEntry(t, content, "example.org:1234"), "example.org:1234")
+	test.Type(findEntry(t, content, "JohnDoe"), "alice")
+	test.Type(findEntry(t, content, "empty to not save"), "work")
+	findForm(t, content).OnSubmit()
+
+	expectEvent(t, screens.state.GuiBus, GuiEventShowMessage)
+	if request := expectEvent(t, screens.state.NetBus, NetEventJoin).(NetReqJoin); request.Profile != "work" {
+		t.Errorf("join sent profile '%s', want work", request.Profile)
+	}
+	profiles, err := screens.state.LoadProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile := profiles.Find("work"); profile == nil || profile.Server != "example.org:1234" || profile.Username != "alice" {
+		t.Errorf("profile was not saved: %+v", profile)
+	}
+
+	// editing fills the form back in
+	content = screens.Join("work")
+	if username := findEntry(t, content, "JohnDoe").Text; username != "alice" {
+		t.Errorf("edit form has username '%s', want alice", username)
+	}
+}
+
+func TestJoinOurHostKey(t *testing.T) {
+	screens := newTestScreens(t)
+	client := testClient(screens, "alice")
+
+	if !hasLabel(screens.JoinOurHostKey(client), FormatFingerprint(client.OurPubKey, 4)) {
+		t.Error("our key fingerprint is not shown")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const harnessTimeout = 10 * time.Second
+
+// testNetwork runs a host and any number of clients in one process over
+// loopback, with the real handshake and handlers; it stands in for the GUI
+// by answering prompts on the event bus and collecting everything else
+type testNetwork struct {
+	t           *testing.T
+	state       Andromeda
+	host        *HostConfig
+	events      chan Event // GUI events, in the order they were sent
+	AutoApprove bool       // allow registration requests as soon as they arrive
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	return newTestNetworkWith(t, func(*Andromeda) {})
+}
+
+// newTestNetworkOver is newTestNetwork with every connection going through
+// link, both ways
+func newTestNetworkOver(t *testing.T, link *Link) *testNetwork {
+	return newTestNetworkWith(t, func(state *Andromeda) {
+		state.Link = link
+	})
+}
+
+// newTestNetworkWith lets configure change the state before anything starts
+func newTestNetworkWith(t *testing.T, configure func(*Andromeda)) *testNetwork {
+	dir, err := ioutil.TempDir("", "andromeda-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	logger, err := NewLogger(LogConfig{Level: LogLevelWarn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := &testNetwork{
+		t: t,
+		state: Andromeda{
+			GuiBus:       make(chan Event, 16),
+			NetBus:       make(chan Event, 16),
+			Hosts:        NewHostSet(),
+			HostDefaults: HostSettings{AuthMode: AuthModePassword, MaxAuthFailures: 5},
+			Clients:      NewClientSet(),
+			Credentials:  &CredentialStore{},
+			Limits:       DefaultAcceptLimits,
+			Deadlines:    DefaultDeadlines,
+			Queues:       DefaultSendQueueConfig,
+			Work:         NewWorkPool(DefaultAcceptLimits.Workers, DefaultAcceptLimits.Queue),
+			Pending:      NewPendingLimiter(DefaultAcceptLimits.PendingPerIP),
+			Log:          logger,
+			ConfigDir:    dir,
+		},
+		events: make(chan Event, 1024),
+	}
+	configure(&network.state)
+	go NetHandle(network.state)()
+	go network.pump()
+
+	network.host, err = network.state.StartHost("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, client := range network.state.Clients.List() {
+			client.Conn.Close()
+		}
+		network.state.StopHost(network.host)
+	})
+	return network
+}
+
+// pump answers the prompts a user would click through and records events
+func (network *testNetwork) pump() {
+	for request := range network.state.GuiBus {
+		network.state.Events.Publish(request)
+		switch request.ID {
+		case GuiEventShowJoinUnknownConnection:
+			network.state.NetBus <- Event{
+				NetEventJoinUnknownConnection,
+				NetReqJoinUnknownConnection{request.Event.(GuiReqShowJoinUnknownConnection).Client, true},
+			}
+		case GuiEventHostChanged:
+			if network.AutoApprove {
+				for _, registration := range network.host.Registrations.List() {
+					network.state.NetBus <- Event{
+						NetEventRegistration,
+						NetReqRegistration{network.host.ID, registration.ID, true},
+					}
+				}
+			}
+		}
+		network.events <- request
+	}
+}
+
+func (network *testNetwork) address() string {
+	return network.host.listener.Addr().String()
+}
+
+// addUser creates an account on the host as if it had registered before
+func (network *testNetwork) addUser(name, password string, role Role) {
+	_, verifier, err := ScramClientProof(password, randomBytes(scramSaltSize), scramMinIterations, nil)
+	if err != nil {
+		network.t.Fatal(err)
+	}
+	network.host.Lock()
+	network.host.Users = append(network.host.Users, &User{Name: name, Role: role, Verifier: verifier})
+	network.host.Unlock()
+}
+
+// join connects a new client as username, each with its own identity key
+func (network *testNetwork) join(username, password string) {
+	network.state.NetBus <- Event{
+		NetEventJoin,
+		NetReqJoin{
+			Server:   network.address(),
+			Username: username,
+			Password: password,
+			Identity: "test-" + username,
+		},
+	}
+}
+
+// client returns the connected client logged in as username, nil if none
+func (network *testNetwork) client(username string) *ClientConfig {
+	for _, client := range network.state.Clients.List() {
+		if client.Username == username {
+			return client
+		}
+	}
+	return nil
+}
+
+// waitEvent returns the first GUI event from now on that match accepts
+func (network *testNetwork) waitEvent(what string, match func(Event) bool) Event {
+	network.t.Helper()
+	timeout := time.After(harnessTimeout)
+	for {
+		select {
+		case event := <-network.events:
+			if match(event) {
+				return event
+			}
+		case <-timeout:
+			network.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitUntil polls condition, for state that isn't announced on the bus
+func (network *testNetwork) waitUntil(what string, condition func() bool) {
+	network.t.Helper()
+	deadline := time.Now().Add(harnessTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			network.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLoggedIn waits for username's client to be told its login succeeded
+func (network *testNetwork) waitLoggedIn(username string) *ClientConfig {
+	network.t.Helper()
+	event := network.waitEvent("'"+username+"' to log in", func(event Event) bool {
+		var id int
+		switch request := event.Event.(type) {
+		case GuiReqShowVerify:
+			id = request.Client
+		case GuiReqShowSession:
+			id = request.Client
+		}
+		client := network.state.Clients.Get(id)
+		return client != nil && client.Username == username
+	})
+	var id int
+	if verify, ok := event.Event.(GuiReqShowVerify); ok {
+		id = verify.Client
+	} else {
+		id = event.Event.(GuiReqShowSession).Client
+	}
+	return network.state.Clients.Get(id)
+}
+
+// waitMessage waits for a message screen containing text
+func (network *testNetwork) waitMessage(text string) {
+	network.t.Helper()
+	network.waitEvent("message '"+text+"'", func(event Event) bool {
+		message, ok := event.Event.(GuiReqShowMessage)
+		return ok && strings.Contains(message.Content, text)
+	})
+}
+
+// session returns username's live session on the host, nil if offline
+func (network *testNetwork) session(username string) *Session {
+	network.host.Lock()
+	defer network.host.Unlock()
+	if user := network.host.findUser(username); user != nil {
+		return user.Session
+	}
+	return nil
+}
+
+// audited reports whether the host audited an event of kind for username
+func (network *testNetwork) audited(kind, username string) bool {
+	for _, event := range network.host.Audit.Events(AuditFilter{Kind: kind}, 0) {
+		if event.Username == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coderobe/securenet"
+)
+
+// HostSet holds the networks we are hosting at the same time, by ID
+type HostSet struct {
+	sync.Mutex
+	next  int
+	hosts map[int]*HostConfig
+}
+
+func NewHostSet() *HostSet {
+	return &HostSet{hosts: make(map[int]*HostConfig)}
+}
+
+// Add registers config unless a network of the same name is already running
+func (set *HostSet) Add(config *HostConfig) (int, error) {
+	set.Lock()
+	defer set.Unlock()
+	for _, host := range set.hosts {
+		if host.Name == config.Name {
+			return 0, errors.New("network '" + config.Name + "' is already running")
+		}
+	}
+	set.next++
+	config.ID = set.next
+	set.hosts[config.ID] = config
+	return config.ID, nil
+}
+
+// Get returns the host with id, nil once it has been stopped
+func (set *HostSet) Get(id int) *HostConfig {
+	set.Lock()
+	defer set.Unlock()
+	return set.hosts[id]
+}
+
+func (set *HostSet) Remove(id int) {
+	set.Lock()
+	delete(set.hosts, id)
+	set.Unlock()
+}
+
+// List returns the running networks, oldest first
+func (set *HostSet) List() (hosts []*HostConfig) {
+	set.Lock()
+	defer set.Unlock()
+	for _, host := range set.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].ID < hosts[j].ID
+	})
+	return
+}
+
+// NewHostConfig sets up an empty network with the given policy
+func NewHostConfig(name string, settings HostSettings, audit *AuditLog) *HostConfig {
+	return &HostConfig{
+		Name:                name,
+		RegistrationEnabled: settings.RegistrationEnabled,
+		AuthMode:            settings.AuthMode,
+		AdminsNeedBoth:      settings.AdminsNeedBoth,
+		MaxAuthFailures:     settings.MaxAuthFailures,
+		PublicAddress:       settings.PublicAddress,
+		Logins:              NewLoginLimiter(DefaultLoginLimitConfig),
+		Registrations:       NewRegistrationQueue(),
+		Invites:             NewInviteStore(),
+		Audit:               audit,
+		done:                make(chan struct{}),
+	}
+}
+
+// networkPath resolves file inside the config directory of network name
+func (state Andromeda) networkPath(name, file string) (string, error) {
+	if !validIdentityName(name) {
+		return "", errors.New("invalid network name '" + name + "'")
+	}
+	return state.configPath(filepath.Join("networks", name, file))
+}
+
+// StartHost listens on address as network name, with the key and audit log
+// kept for that name, and accepts connections until StopHost
+func (state Andromeda) StartHost(name, address string) (*HostConfig, error) {
+	log := state.Log.With("net")
+
+	keyPath, err := state.networkPath(name, "identity.json")
+	if err != nil {
+		return nil, err
+	}
+	identity, err := loadIdentityFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	auditPath, err := state.networkPath(name, "audit.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := OpenAuditLog(auditPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log: %w", err)
+	}
+	if broken := auditLog.Verify(); broken != 0 {
+		log.Error("Audit log has been tampered with or cut short", "network", name, "entry", broken)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		auditLog.Close()
+		return nil, err
+	}
+	config := NewHostConfig(name, state.HostDefaults, auditLog)
+	config.Address = address
+	config.PubKey = identity.PubKey
+	config.listener = listener
+	config.bound = listener.Addr().String()
+	if _, err := state.Hosts.Add(config); err != nil {
+		listener.Close()
+		auditLog.Close()
+		return nil, err
+	}
+	log.Info("Host ready", "network", name, "address", listener.Addr(), "pubkey", config.PubKey)
+	audit(state, config, AuditEvent{Kind: AuditHostStarted, Key: auditKey(config.PubKey), Remote: listener.Addr().String()})
+
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-config.done:
+				return
+			case <-ticker.C:
+			}
+			expired := config.Registrations.Expire(time.Now())
+			for _, registration := range expired {
+				log.Info("Registration request expired", "network", name, "user", registration.Username, "remote", registration.Session.Remote)
+				state.Metrics.Add("andromeda_registrations_total", metricLabels("network", name, "outcome", "expired"), 1)
+				registration.Session.Send(packetAuthStatus, MessageAuthStatus{})
+				audit(state, config, AuditEvent{Kind: AuditRegistrationExpired, Username: registration.Username, Key: auditKey(registration.PubKey), Remote: registration.Session.Remote})
+				notifyPermitted(config, PermissionApproveRegistrations, packetRegistrationDecision, MessageRegistrationDecision{registration.ID, false})
+			}
+			if len(expired) > 0 {
+				state.GuiBus <- Event{
+					GuiEventHostChanged,
+					GuiReqHostChanged{config.ID},
+				}
+			}
+		}
+	}()
+
+	pub, priv, elligator := identity.keys()
+	go func() {
+		for {
+			pConn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-config.done:
+					log.Info("Host stopped", "network", name)
+					return
+				default:
+				}
+				log.Warn("Accept failed", "network", name, "error", err)
+				continue
+			}
+			log.Info("Got new connection", "network", name, "remote", pConn.RemoteAddr())
+			ip := remoteIP(pConn.RemoteAddr())
+			if !state.Pending.Acquire(ip) {
+				log.Warn("Too many connections from address waiting to log in, rejecting", "network", name, "remote", pConn.RemoteAddr())
+				pConn.Close()
+				continue
+			}
+			go func() {
+				if timeout := state.Deadlines.Handshake; timeout > 0 {
+					pConn.SetDeadline(time.Now().Add(timeout))
+				}
+				var conn securenet.Conn
+				var handshakeErr error
+				started := time.Now()
+				err := state.Work.Do(func() {
+					conn, handshakeErr = securenet.WrapWithKeys(state.Link.Wrap(pConn), *pub, *priv, *elligator)
+				})
+				if err == nil {
+					err = handshakeErr
+				}
+				if err != nil {
+					log.Warn("Handshake failed", "network", name, "remote", pConn.RemoteAddr(), "error", err)
+					state.Metrics.Add("andromeda_handshake_failures_total", metricLabels("network", name), 1)
+					pConn.Close()
+					state.Pending.Release(ip)
+					return
+				}
+				pConn.SetDeadline(time.Time{})
+				state.Metrics.Observe("andromeda_handshake_seconds", metricLabels("network", name), time.Since(started).Seconds())
+				handleHostConnection(state, config, log, newFrameConn(conn))
+			}()
+		}
+	}()
+	return config, nil
+}
+
+// StopHost closes the listener of config and drops every session on it
+func (state Andromeda) StopHost(config *HostConfig) {
+	state.Hosts.Remove(config.ID)
+	close(config.done)
+	if config.listener != nil {
+		config.listener.Close()
+	}
+	config.Lock()
+	var sessions []*Session
+	for _, user := range config.Users {
+		if user.Session != nil {
+			sessions = append(sessions, user.Session)
+		}
+	}
+	config.Unlock()
+	for _, session := range sessions {
+		session.Close()
+	}
+	for _, registration := range config.Registrations.List() {
+		registration.Session.Close()
+	}
+	config.Audit.Close()
+}
+
+// hostFlags collects repeated -host name=address flags
+type hostFlags map[string]string
+
+func (flags hostFlags) String() string {
+	var pairs []string
+	for name, address := range flags {
+		pairs = append(pairs, name+"="+address)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (flags hostFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[1] == "" || !validIdentityName(parts[0]) {
+		return errors.New("expected name=address")
+	}
+	flags[parts[0]] = parts[1]
+	return nil
+}
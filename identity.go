@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coderobe/securenet"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	DefaultIdentity      = "default"
+	identityExportPrefix = "andromeda-identity-v1:"
+)
+
+// Identity is a long-lived securenet keypair, so hosts can recognise a
+// device across sessions
+type Identity struct {
+	PubKey    []byte
+	PrivKey   []byte
+	Elligator []byte
+}
+
+func NewIdentity() (*Identity, error) {
+	pub, priv, elligator, err := securenet.GenerateKeys()
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{pub[:], priv[:], elligator[:]}, nil
+}
+
+func validIdentityName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// IdentityNameForServer is the identity used when a network gets its own key
+func IdentityNameForServer(server string) string {
+	name := "net-"
+	for _, c := range server {
+		if validIdentityName(string(c)) {
+			name += string(c)
+		} else {
+			name += "_"
+		}
+	}
+	return name
+}
+
+func (state Andromeda) identityPath(name string) (string, error) {
+	if !validIdentityName(name) {
+		return "", errors.New("invalid identity name '" + name + "'")
+	}
+	return state.configPath(filepath.Join("identities", name+".json"))
+}
+
+// LoadIdentity reads the named identity, generating and saving a new one
+// if none exists yet
+func (state Andromeda) LoadIdentity(name string) (*Identity, error) {
+	path, err := state.identityPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return loadIdentityFile(path)
+}
+
+func loadIdentityFile(path string) (*Identity, error) {
+	var identity Identity
+	err := loadJSON(path, &identity)
+	if os.IsNotExist(err) {
+		generated, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		return generated, saveJSON(path, generated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := identity.validate(); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (state Andromeda) SaveIdentity(name string, identity *Identity) error {
+	path, err := state.identityPath(name)
+	if err != nil {
+		return err
+	}
+	return saveJSON(path, identity)
+}
+
+func (state Andromeda) ListIdentities() (names []string, err error) {
+	dir, err := state.configPath("identities")
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range files {
+		if name := strings.TrimSuffix(file.Name(), ".json"); name != file.Name() && validIdentityName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func (identity *Identity) validate() error {
+	if len(identity.PubKey) != 32 || len(identity.PrivKey) != 32 || len(identity.Elligator) != 32 {
+		return errors.New("identity keys are malformed")
+	}
+	return nil
+}
+
+func (identity *Identity) keys() (pub, priv, elligator *[32]byte) {
+	pub, priv, elligator = new([32]byte), new([32]byte), new([32]byte)
+	copy(pub[:], identity.PubKey)
+	copy(priv[:], identity.PrivKey)
+	copy(elligator[:], identity.Elligator)
+	return
+}
+
+// Dial connects to a host presenting this identity instead of an ephemeral key,
+// through link if one is being simulated. Connecting and the key exchange
+// have to be done within timeout, unless it is 0
+func (identity *Identity) Dial(address string, link *Link, timeout time.Duration) (securenet.Conn, error) {
+	pConn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	pConn = link.Wrap(pConn)
+	if timeout > 0 {
+		pConn.SetDeadline(time.Now().Add(timeout))
+	}
+	pub, priv, elligator := identity.keys()
+	conn, err := securenet.WrapWithKeys(pConn, *pub, *priv, *elligator)
+	if err != nil {
+		pConn.Close()
+		return nil, err
+	}
+	pConn.SetDeadline(time.Time{})
+	return newFrameConn(conn), nil
+}
+
+func passphraseKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// Export seals the identity with a passphrase into a string that can be
+// carried over to another machine
+func (identity *Identity) Export(passphrase string) (string, error) {
+	if passphrase == "" {
+		return "", errors.New("an export passphrase is required")
+	}
+	plain, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+	salt := randomBytes(16)
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	var nonce [24]byte
+	copy(nonce[:], randomBytes(len(nonce)))
+	sealed := secretbox.Seal(append(append([]byte{}, salt...), nonce[:]...), plain, &nonce, key)
+	return identityExportPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func ImportIdentity(exported, passphrase string) (*Identity, error) {
+	exported = strings.TrimSpace(exported)
+	if !strings.HasPrefix(exported, identityExportPrefix) {
+		return nil, errors.New("not an exported identity")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(exported, identityExportPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < 16+24+secretbox.Overhead {
+		return nil, errors.New("exported identity is truncated")
+	}
+	key, err := passphraseKey(passphrase, sealed[:16])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[16:40])
+	plain, ok := secretbox.Open(nil, sealed[40:], &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong passphrase or corrupted export")
+	}
+	var identity Identity
+	if err := json.Unmarshal(plain, &identity); err != nil {
+		return nil, err
+	}
+	if err := identity.validate(); err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const joinLinkScheme = "andromeda"
+
+type Invite struct {
+	Code     string
+	Username string // only this username may redeem it, if set
+	Role     Role
+	OneTime  bool
+	Created  time.Time
+	Expires  time.Time // zero for invites that never expire
+	Uses     int
+}
+
+func (invite *Invite) Expired(now time.Time) bool {
+	return !invite.Expires.IsZero() && now.After(invite.Expires)
+}
+
+// InviteStore holds the invite codes a host has minted
+type InviteStore struct {
+	sync.Mutex
+	invites map[string]*Invite
+}
+
+func NewInviteStore() *InviteStore {
+	return &InviteStore{invites: make(map[string]*Invite)}
+}
+
+func (store *InviteStore) Create(username string, role Role, oneTime bool, ttl time.Duration) *Invite {
+	invite := &Invite{
+		Code:     base64.RawURLEncoding.EncodeToString(randomBytes(18)),
+		Username: username,
+		Role:     role,
+		OneTime:  oneTime,
+		Created:  time.Now(),
+	}
+	if ttl > 0 {
+		invite.Expires = invite.Created.Add(ttl)
+	}
+	store.Lock()
+	store.invites[invite.Code] = invite
+	store.Unlock()
+	return invite
+}
+
+func (store *InviteStore) Revoke(code string) {
+	store.Lock()
+	delete(store.invites, code)
+	store.Unlock()
+}
+
+// List returns the invites that can still be redeemed, newest first
+func (store *InviteStore) List() (invites []*Invite) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	for code, invite := range store.invites {
+		if invite.Expired(now) {
+			delete(store.invites, code)
+			continue
+		}
+		invites = append(invites, invite)
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Created.After(invites[j].Created)
+	})
+	return
+}
+
+func (store *InviteStore) lookup(code, username string) (*Invite, error) {
+	invite := store.invites[code]
+	if invite == nil || invite.Expired(time.Now()) {
+		return nil, errors.New("unknown or expired invite")
+	}
+	if invite.Username != "" && invite.Username != username {
+		return nil, errors.New("invite is for a different username")
+	}
+	return invite, nil
+}
+
+// Check reports whether username may redeem code, without using it up
+func (store *InviteStore) Check(code, username string) error {
+	store.Lock()
+	defer store.Unlock()
+	_, err := store.lookup(code, username)
+	return err
+}
+
+// Redeem uses code up for username once register has accepted it; if
+// register fails the invite is left as it was
+func (store *InviteStore) Redeem(code, username string, register func(*Invite) error) (*Invite, error) {
+	store.Lock()
+	defer store.Unlock()
+	invite, err := store.lookup(code, username)
+	if err != nil {
+		return nil, err
+	}
+	if err := register(invite); err != nil {
+		return nil, err
+	}
+	invite.Uses++
+	if invite.OneTime {
+		delete(store.invites, code)
+	}
+	return invite, nil
+}
+
+var (
+	errWildcardJoinAddress = errors.New("the host listens on every interface, set a public address for join links")
+	errLoopbackJoinAddress = errors.New("join links point at this machine only, set a public address to let others in")
+)
+
+// checkPublicAddress accepts a host or host:port for join links, or empty
+// for the listen address
+func checkPublicAddress(address string) error {
+	if address == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), "0"
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil || host == "" || strings.ContainsAny(host, "/?#@[] ") {
+		return errors.New("public address must be a host or host:port")
+	}
+	return nil
+}
+
+// JoinAddress is where join links send clients: the public address, taking
+// the port we listen on if it has none, or else the listen address. A
+// wildcard listen address can't be put in a link and is refused; a loopback
+// one comes with an error to warn with.
+func (config *HostConfig) JoinAddress() (string, error) {
+	config.Lock()
+	address := config.PublicAddress
+	config.Unlock()
+	listening := config.bound
+	if listening == "" {
+		listening = config.Address
+	}
+	if address == "" {
+		address = listening
+	} else if _, _, err := net.SplitHostPort(address); err != nil {
+		_, port, _ := net.SplitHostPort(listening)
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case host == "" || ip != nil && ip.IsUnspecified():
+		return "", errWildcardJoinAddress
+	case host == "localhost" || ip != nil && ip.IsLoopback():
+		return address, errLoopbackJoinAddress
+	}
+	return address, nil
+}
+
+// JoinLink carries everything a client needs to join a network: where it
+// is, the key the host must present and optionally an invite code
+type JoinLink struct {
+	Server  string
+	HostKey []byte
+	Invite  string
+}
+
+func (link JoinLink) String() string {
+	query := url.Values{}
+	query.Set("key", base64.RawURLEncoding.EncodeToString(link.HostKey))
+	if link.Invite != "" {
+		query.Set("invite", link.Invite)
+	}
+	return (&url.URL{
+		Scheme:   joinLinkScheme,
+		Host:     link.Server,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+func ParseJoinLink(text string) (*JoinLink, error) {
+	parsed, err := url.Parse(strings.TrimSpace(text))
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != joinLinkScheme || parsed.Host == "" {
+		return nil, errors.New("not an andromeda join link")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(parsed.Query().Get("key"))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("join link has no valid host key")
+	}
+	return &JoinLink{
+		Server:  parsed.Host,
+		HostKey: key,
+		Invite:  parsed.Query().Get("invite"),
+	}, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestJoinAddress(t *testing.T) {
+	for _, c := range []struct {
+		listen, public, want string
+		err                  error
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1:1234", nil},
+		{"0.0.0.0:1234", "example.org", "example.org:1234", nil},
+		{"[::]:1234", "example.org:4321", "example.org:4321", nil},
+		{"[::]:1234", "2001:db8::1", "[2001:db8::1]:1234", nil},
+		{":1234", "", "", errWildcardJoinAddress},
+		{"0.0.0.0:1234", "", "", errWildcardJoinAddress},
+		{"127.0.0.1:1234", "", "127.0.0.1:1234", errLoopbackJoinAddress},
+		{"0.0.0.0:1234", "localhost", "localhost:1234", errLoopbackJoinAddress},
+	} {
+		config := NewHostConfig("test", HostSettings{PublicAddress: c.public}, nil)
+		config.bound = c.listen
+		if got, err := config.JoinAddress(); got != c.want || err != c.err {
+			t.Errorf("listening on %q with public address %q: got %q, %v", c.listen, c.public, got, err)
+		}
+	}
+}
+
+func TestCheckPublicAddress(t *testing.T) {
+	for _, good := range []string{"", "example.org", "example.org:1234", "192.0.2.1", "2001:db8::1", "[2001:db8::1]:1234"} {
+		if err := checkPublicAddress(good); err != nil {
+			t.Errorf("refused %q: %v", good, err)
+		}
+	}
+	for _, bad := range []string{":1234", "example.org:port", "example.org:99999", "example.org/path", "user@example.org"} {
+		if checkPublicAddress(bad) == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
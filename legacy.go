@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blowfish"
+)
+
+// Hosts from before SCRAM kept bcrypt hashes of passwords. A user that only
+// has one is challenged with the hash's salt and cost: the client runs bcrypt
+// over the password itself and the resulting hash string stands in for the
+// password, so the host can check the proof against a verifier made from the
+// hash it already has. Along with the proof the client sends a verifier of
+// the password proper, which replaces the hash once the login succeeded.
+//
+// The bcrypt package only hashes with a fresh salt, so its core is repeated
+// here; legacy_test.go holds it to the package's results.
+
+const (
+	bcryptSaltSize = 22 // encoded
+	bcryptHashSize = 31 // encoded, follows the salt
+	bcryptMinCost  = 4
+	bcryptMaxCost  = 16 // more than a host may make a client spend on a login
+)
+
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+var errBadBcryptSalt = errors.New("host sent a malformed bcrypt salt")
+
+// bcryptSalt is the start of a bcrypt hash up to and including the salt,
+// e.g. $2a$10$N9qo8uLOickgx2ZMRZoMye
+func bcryptSalt(hashed []byte) string {
+	if len(hashed) <= bcryptHashSize {
+		return ""
+	}
+	return string(hashed[:len(hashed)-bcryptHashSize])
+}
+
+// bcryptWithSalt hashes password like bcrypt would with the version, cost and
+// salt of prefix, returning the whole hash string
+func bcryptWithSalt(password, prefix string) (string, error) {
+	parts := strings.Split(prefix, "$")
+	if len(parts) != 4 || parts[0] != "" || len(parts[1]) < 1 || len(parts[1]) > 2 || parts[1][0] != '2' || len(parts[2]) != 2 || len(parts[3]) != bcryptSaltSize {
+		return "", errBadBcryptSalt
+	}
+	cost, err := strconv.Atoi(parts[2])
+	if err != nil || cost < bcryptMinCost || cost > bcryptMaxCost {
+		return "", errBadBcryptSalt
+	}
+	salt, err := bcryptEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", errBadBcryptSalt
+	}
+
+	key := append([]byte(password), 0) // C implementations include the terminating NUL
+	cipher, err := blowfish.NewSaltedCipher(key, salt)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < 1<<uint(cost); i++ {
+		blowfish.ExpandKey(key, cipher)
+		blowfish.ExpandKey(salt, cipher)
+	}
+	data := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < len(data); i += blowfish.BlockSize {
+		for j := 0; j < 64; j++ {
+			cipher.Encrypt(data[i:i+blowfish.BlockSize], data[i:i+blowfish.BlockSize])
+		}
+	}
+	return prefix + bcryptEncoding.EncodeToString(data[:23]), nil // only 23 bytes, like every other bcrypt
+}
+
+// answerChallenge proves knowledge of password to a host; the verifier
+// checks the host's signature
+func answerChallenge(password string, challenge MessageAuthChallenge, authMessage []byte) (proof MessageAuthProof, verifier *ScramVerifier, err error) {
+	hashed := password
+	if challenge.Bcrypt != "" {
+		if hashed, err = bcryptWithSalt(password, challenge.Bcrypt); err != nil {
+			return
+		}
+	}
+	if proof.Proof, verifier, err = ScramClientProof(hashed, challenge.Salt, challenge.Iterations, authMessage); err != nil {
+		return
+	}
+	switch {
+	case challenge.Register:
+		proof.Verifier = verifier
+	case challenge.Bcrypt != "":
+		_, proof.Verifier, err = ScramClientProof(password, challenge.Salt, challenge.Iterations, authMessage)
+	}
+	return
+}
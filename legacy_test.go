@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBcryptWithSalt(t *testing.T) {
+	for _, password := range []string{"", "correct horse", strings.Repeat("long", 18)} {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bcryptWithSalt(password, bcryptSalt(hashed))
+		if err != nil || got != string(hashed) {
+			t.Errorf("hashing %q gave %q, %v, want %q", password, got, err, hashed)
+		}
+	}
+	// from the Openwall test vectors
+	if got, _ := bcryptWithSalt("U*U", "$2a$05$CCCCCCCCCCCCCCCCCCCCC."); got != "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW" {
+		t.Errorf("test vector hashed to %q", got)
+	}
+}
+
+func TestBcryptWithSaltRefusesBadSalts(t *testing.T) {
+	salt := "N9qo8uLOickgx2ZMRZoMye"
+	for _, prefix := range []string{
+		"",
+		"$2a$10$",
+		"$2a$10$" + salt[1:],
+		"$3a$10$" + salt,
+		"$2a$1$" + salt,
+		"$2a$03$" + salt,
+		"$2a$31$" + salt, // a host can't make clients hash for days
+		"$2a$10$" + salt[1:] + "!",
+		"$2a$10$" + salt + "$",
+	} {
+		if _, err := bcryptWithSalt("password", prefix); err == nil {
+			t.Errorf("hashed with salt %q", prefix)
+		}
+	}
+}
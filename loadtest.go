@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coderobe/securenet"
+	"github.com/vmihailenco/msgpack/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	loadTestPassword   = "load test password"
+	loadTestBcryptCost = 10
+)
+
+// LoadTestConfig sizes a load test against a host started in-process
+type LoadTestConfig struct {
+	Clients     int           // members logged in at the same time
+	Concurrency int           // logins in flight at once, 0 for all of them
+	Legacy      bool          // give members bcrypt hashes, so every login pays for bcrypt
+	Hold        time.Duration // how long members stay connected once all are in
+	Timeout     time.Duration // per login, from dial to auth status
+}
+
+// LatencyStats summarises how long one step took across all clients
+type LatencyStats struct {
+	Min, Median, P95, P99, Max time.Duration
+}
+
+func newLatencyStats(samples []time.Duration) LatencyStats {
+	if len(samples) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	at := func(fraction float64) time.Duration {
+		return samples[int(fraction*float64(len(samples)-1))]
+	}
+	return LatencyStats{samples[0], at(0.5), at(0.95), at(0.99), samples[len(samples)-1]}
+}
+
+func (stats LatencyStats) String() string {
+	return fmt.Sprintf("min %v  median %v  p95 %v  p99 %v  max %v",
+		stats.Min.Round(time.Microsecond), stats.Median.Round(time.Microsecond),
+		stats.P95.Round(time.Microsecond), stats.P99.Round(time.Microsecond), stats.Max.Round(time.Microsecond))
+}
+
+// LoadTestReport is what a load test measured. Memory and goroutines are for
+// the whole process, so they include the load clients' own connections
+type LoadTestReport struct {
+	Clients   int
+	Failed    int
+	Errors    map[string]int // failure reasons and how often they came up
+	Elapsed   time.Duration  // from the first dial until every login finished
+	Handshake LatencyStats   // dial and key exchange
+	Auth      LatencyStats   // first auth packet until the auth status
+
+	GoroutinesBefore    int
+	GoroutinesConnected int
+	HeapBefore          uint64 // bytes in use after a GC, before any client connected
+	HeapConnected       uint64 // the same with every client logged in
+	Sessions            int    // sessions the host had open with every client in
+}
+
+func (report LoadTestReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "clients:     %d connected, %d failed in %v\n", report.Clients-report.Failed, report.Failed, report.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "handshake:   %v\n", report.Handshake)
+	fmt.Fprintf(&b, "auth:        %v\n", report.Auth)
+	fmt.Fprintf(&b, "sessions:    %d on the host\n", report.Sessions)
+	fmt.Fprintf(&b, "goroutines:  %d before, %d connected\n", report.GoroutinesBefore, report.GoroutinesConnected)
+	fmt.Fprintf(&b, "heap:        %.1f MiB before, %.1f MiB connected\n", mib(report.HeapBefore), mib(report.HeapConnected))
+	if connected := report.Clients - report.Failed; connected > 0 {
+		fmt.Fprintf(&b, "per member:  %.1f goroutines, %.1f KiB heap\n",
+			float64(report.GoroutinesConnected-report.GoroutinesBefore)/float64(connected),
+			(float64(report.HeapConnected)-float64(report.HeapBefore))/1024/float64(connected))
+	}
+	var reasons []string
+	for reason := range report.Errors {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "error:       %dx %s\n", report.Errors[reason], reason)
+	}
+	return b.String()
+}
+
+func mib(bytes uint64) float64 {
+	return float64(bytes) / 1024 / 1024
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// RunLoadTest hosts a throwaway network on loopback, logs config.Clients
+// members into it through the real accept loop and measures the host.
+// Handshakes go through state.Work like any other, but not the per address
+// limit. Connections go through state.Link if one is being simulated
+func RunLoadTest(state Andromeda, config LoadTestConfig) (LoadTestReport, error) {
+	log := state.Log.With("load")
+	report := LoadTestReport{Clients: config.Clients, Errors: make(map[string]int)}
+	if config.Clients <= 0 {
+		return report, errors.New("need at least one client")
+	}
+	if config.Concurrency <= 0 || config.Concurrency > config.Clients {
+		config.Concurrency = config.Clients
+	}
+	if config.Timeout == 0 {
+		config.Timeout = time.Minute
+	}
+
+	dir, err := ioutil.TempDir("", "andromeda-load")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(dir)
+	state.ConfigDir = dir
+	state.GuiBus = make(chan Event, 64)
+	state.Hosts = NewHostSet()
+	state.Pending = nil      // every load client comes from the same address
+	state.Deadlines.Idle = 0 // and holds its connection without keepalives
+	go func() {
+		for range state.GuiBus {
+		}
+	}()
+
+	host, err := state.StartHost("load", "127.0.0.1:0")
+	if err != nil {
+		return report, err
+	}
+	defer state.StopHost(host)
+	address := host.listener.Addr().String()
+
+	// every member shares one password, so the credentials are made once
+	var hashed []byte
+	var verifier *ScramVerifier
+	if config.Legacy {
+		if hashed, err = bcrypt.GenerateFromPassword([]byte(loadTestPassword), loadTestBcryptCost); err != nil {
+			return report, err
+		}
+	} else if _, verifier, err = ScramClientProof(loadTestPassword, randomBytes(scramSaltSize), scramMinIterations, nil); err != nil {
+		return report, err
+	}
+	host.Lock()
+	for i := 0; i < config.Clients; i++ {
+		user := &User{Name: fmt.Sprintf("load%d", i), Role: RoleMember, HashedPassword: hashed}
+		if verifier != nil {
+			copied := *verifier
+			user.Verifier = &copied
+		}
+		host.Users = append(host.Users, user)
+	}
+	host.Unlock()
+
+	report.GoroutinesBefore = runtime.NumGoroutine()
+	report.HeapBefore = heapInUse()
+	log.Info("Starting load test", "clients", config.Clients, "concurrency", config.Concurrency, "legacy", config.Legacy, "address", address)
+
+	var lock sync.Mutex
+	var handshakes, auths []time.Duration
+	var conns []net.Conn
+	slots := make(chan struct{}, config.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < config.Clients; i++ {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(username string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			conn, handshake, auth, err := loadTestLogin(state.Link, address, username, config.Timeout)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				log.Debug("Load test login failed", "user", username, "error", err)
+				report.Failed++
+				report.Errors[err.Error()]++
+				return
+			}
+			handshakes = append(handshakes, handshake)
+			auths = append(auths, auth)
+			conns = append(conns, conn)
+		}(fmt.Sprintf("load%d", i))
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	report.Handshake = newLatencyStats(handshakes)
+	report.Auth = newLatencyStats(auths)
+
+	report.GoroutinesConnected = runtime.NumGoroutine()
+	report.HeapConnected = heapInUse()
+	host.Lock()
+	for _, user := range host.Users {
+		if user.Session != nil {
+			report.Sessions++
+		}
+	}
+	host.Unlock()
+	log.Info("Load test clients connected", "connected", len(conns), "failed", report.Failed, "elapsed", report.Elapsed)
+
+	time.Sleep(config.Hold)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return report, nil
+}
+
+// loadTestLogin connects and logs in as username with a bare client that
+// holds the connection afterwards and doesn't read from it again
+func loadTestLogin(link *Link, address, username string, timeout time.Duration) (conn securenet.Conn, handshake, auth time.Duration, err error) {
+	start := time.Now()
+	pConn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	pConn = link.Wrap(pConn)
+	pConn.SetDeadline(start.Add(timeout))
+	pub, priv, elligator, err := securenet.GenerateKeys()
+	if err != nil {
+		pConn.Close()
+		return nil, 0, 0, err
+	}
+	conn, err = securenet.WrapWithKeys(pConn, pub, priv, elligator)
+	if err != nil {
+		pConn.Close()
+		return nil, 0, 0, err
+	}
+	conn = newFrameConn(conn)
+	handshake = time.Since(start)
+
+	ok := false
+	defer func() {
+		if !ok {
+			pConn.Close() // conn is already nil by the time a failed return gets here
+		}
+	}()
+	start = time.Now()
+	sendMessage := boundSendMessage(conn)
+	decoder := msgpack.NewDecoder(conn)
+	hello := MessageAuth{Username: username, Nonce: randomBytes(scramNonceSize)}
+	if err := sendMessage(packetAuth, hello); err != nil {
+		return nil, 0, 0, err
+	}
+	var authMessage []byte
+	var verifier *ScramVerifier
+	for {
+		packetID, packet, err := readPacket(conn, decoder)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		switch packetID {
+		case packetAuthChallenge:
+			challenge := *packet.(*MessageAuthChallenge)
+			authMessage = scramAuthMessage(username, hello.Nonce, challenge.Nonce, conn.GetPublicKey()[:], conn.GetServerPublicKey()[:])
+			var proof MessageAuthProof
+			proof, verifier, err = answerChallenge(loadTestPassword, challenge, authMessage)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if err := sendMessage(packetAuthProof, proof); err != nil {
+				return nil, 0, 0, err
+			}
+		case packetAuthStatus:
+			status := *packet.(*MessageAuthStatus)
+			if !status.Success {
+				return nil, 0, 0, errors.New("login refused")
+			}
+			if verifier == nil || !verifier.VerifyServerSignature(authMessage, status.ServerSignature) {
+				return nil, 0, 0, errors.New("bad server signature")
+			}
+			pConn.SetDeadline(time.Time{})
+			ok = true
+			return conn, handshake, time.Since(start), nil
+		case packetPing:
+			sendMessage(packetPong, *packet.(*MessagePing))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLoadState(t *testing.T) Andromeda {
+	logger, err := NewLogger(LogConfig{Level: LogLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Andromeda{
+		HostDefaults: HostSettings{AuthMode: AuthModePassword, MaxAuthFailures: 5},
+		Log:          logger,
+	}
+}
+
+func TestLoadTest(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		report, err := RunLoadTest(testLoadState(t), LoadTestConfig{Clients: 8, Concurrency: 4, Legacy: legacy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Failed != 0 {
+			t.Errorf("legacy %v: %d logins failed: %v", legacy, report.Failed, report.Errors)
+		}
+		if report.Sessions != 8 {
+			t.Errorf("legacy %v: host had %d sessions, want 8", legacy, report.Sessions)
+		}
+		if report.Auth.Max == 0 || report.Handshake.Max == 0 {
+			t.Errorf("legacy %v: latencies were not measured: %+v", legacy, report)
+		}
+		if !strings.Contains(report.String(), "8 connected, 0 failed") {
+			t.Errorf("legacy %v: unexpected report:\n%s", legacy, report)
+		}
+	}
+}
+
+func TestLoadTestOverBadLink(t *testing.T) {
+	state := testLoadState(t)
+	state.Link = NewLink(LinkConditions{Latency: 10 * time.Millisecond, ReadChunk: 7})
+	report, err := RunLoadTest(state, LoadTestConfig{Clients: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Failed != 0 {
+		t.Errorf("%d logins failed: %v", report.Failed, report.Errors)
+	}
+	if report.Handshake.Min < 10*time.Millisecond {
+		t.Errorf("handshake took %v despite the link latency", report.Handshake.Min)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	stats := newLatencyStats(samples)
+	want := LatencyStats{time.Millisecond, 50 * time.Millisecond, 95 * time.Millisecond, 99 * time.Millisecond, 100 * time.Millisecond}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	if (newLatencyStats(nil) != LatencyStats{}) {
+		t.Error("no samples should give zero stats")
+	}
+}
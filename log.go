@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LogLevelDebug || level > LogLevelError {
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+	return logLevelNames[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, k := range logLevelNames {
+		if strings.EqualFold(name, k) {
+			return LogLevel(i), nil
+		}
+	}
+	return LogLevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Field keys containing any of these never have their value written out
+var logRedactedKeys = []string{"password", "passwd", "passphrase", "secret", "priv", "elligator"}
+
+const logRedacted = "[redacted]"
+
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+type LogEntry struct {
+	Time      time.Time
+	Level     LogLevel
+	Subsystem string
+	Message   string
+	Fields    []LogField
+}
+
+func (entry LogEntry) Text() string {
+	var builder strings.Builder
+	builder.WriteString(entry.Time.Format(time.RFC3339))
+	builder.WriteString(" ")
+	builder.WriteString(fmt.Sprintf("%-5s", strings.ToUpper(entry.Level.String())))
+	if entry.Subsystem != "" {
+		builder.WriteString(" [" + entry.Subsystem + "]")
+	}
+	builder.WriteString(" " + entry.Message)
+	for _, field := range entry.Fields {
+		builder.WriteString(" " + field.Key + "=" + logFormatValue(field.Value))
+	}
+	return builder.String()
+}
+
+func (entry LogEntry) JSON() string {
+	out := map[string]interface{}{
+		"time":      entry.Time.Format(time.RFC3339Nano),
+		"level":     entry.Level.String(),
+		"subsystem": entry.Subsystem,
+		"msg":       entry.Message,
+	}
+	for _, field := range entry.Fields {
+		if _, reserved := out[field.Key]; reserved {
+			field.Key = "field." + field.Key
+		}
+		switch value := field.Value.(type) {
+		case error:
+			out[field.Key] = value.Error()
+		case []byte:
+			out[field.Key] = fmt.Sprintf("%x", value)
+		default:
+			out[field.Key] = value
+		}
+	}
+	encoded, err := json.Marshal(out)
+	if err != nil {
+		return fmt.Sprintf(`{"level":"error","msg":"unencodable log entry: %s"}`, err)
+	}
+	return string(encoded)
+}
+
+func logFormatValue(value interface{}) string {
+	var text string
+	switch v := value.(type) {
+	case []byte:
+		text = fmt.Sprintf("%x", v)
+	case error:
+		text = v.Error()
+	default:
+		text = fmt.Sprint(v)
+	}
+	if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+		return fmt.Sprintf("%q", text)
+	}
+	return text
+}
+
+func logRedact(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, k := range logRedactedKeys {
+		if strings.Contains(lower, k) {
+			return logRedacted
+		}
+	}
+	return value
+}
+
+type LogConfig struct {
+	Level      LogLevel
+	JSON       bool
+	File       string
+	MaxSize    int64 // bytes before the log file is rotated
+	MaxBackups int
+	History    int // entries kept in memory for the log viewer
+}
+
+type logSink struct {
+	mutex   sync.Mutex
+	config  LogConfig
+	outputs []io.Writer
+	history []LogEntry
+	next    int
+	full    bool
+}
+
+// Logger is a subsystem-tagged handle onto a shared log sink
+type Logger struct {
+	sink      *logSink
+	subsystem string
+}
+
+func NewLogger(config LogConfig) (*Logger, error) {
+	if config.History <= 0 {
+		config.History = 1000
+	}
+	sink := &logSink{
+		config:  config,
+		outputs: []io.Writer{os.Stdout},
+		history: make([]LogEntry, config.History),
+	}
+	if config.File != "" {
+		file, err := openRotatingFile(config.File, config.MaxSize, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.outputs = append(sink.outputs, file)
+	}
+	return &Logger{sink: sink}, nil
+}
+
+func (log *Logger) With(subsystem string) *Logger {
+	return &Logger{sink: log.sink, subsystem: subsystem}
+}
+
+func (log *Logger) SetLevel(level LogLevel) {
+	log.sink.mutex.Lock()
+	log.sink.config.Level = level
+	log.sink.mutex.Unlock()
+}
+
+func (log *Logger) Debug(message string, keyvals ...interface{}) {
+	log.write(LogLevelDebug, message, keyvals)
+}
+
+func (log *Logger) Info(message string, keyvals ...interface{}) {
+	log.write(LogLevelInfo, message, keyvals)
+}
+
+func (log *Logger) Warn(message string, keyvals ...interface{}) {
+	log.write(LogLevelWarn, message, keyvals)
+}
+
+func (log *Logger) Error(message string, keyvals ...interface{}) {
+	log.write(LogLevelError, message, keyvals)
+}
+
+// History returns the retained entries at or above level, oldest first
+func (log *Logger) History(level LogLevel) (entries []LogEntry) {
+	sink := log.sink
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	ordered := sink.history[:sink.next]
+	if sink.full {
+		ordered = append(append([]LogEntry{}, sink.history[sink.next:]...), ordered...)
+	}
+	for _, entry := range ordered {
+		if entry.Level >= level {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func (log *Logger) write(level LogLevel, message string, keyvals []interface{}) {
+	sink := log.sink
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if level < sink.config.Level {
+		return
+	}
+
+	entry := LogEntry{
+		Time:      time.Now(),
+		Level:     level,
+		Subsystem: log.subsystem,
+		Message:   message,
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		entry.Fields = append(entry.Fields, LogField{key, logRedact(key, value)})
+	}
+
+	sink.history[sink.next] = entry
+	sink.next = (sink.next + 1) % len(sink.history)
+	if sink.next == 0 {
+		sink.full = true
+	}
+
+	line := entry.Text()
+	if sink.config.JSON {
+		line = entry.JSON()
+	}
+	for _, out := range sink.outputs {
+		fmt.Fprintln(out, line)
+	}
+}
+
+// rotatingFile is an append-only log file that is moved aside to
+// path.1 ... path.N once it grows past maxSize
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if path == "" {
+		return nil, errors.New("no log file path given")
+	}
+	rotating := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+func (rotating *rotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+	if rotating.maxBackups > 0 {
+		for i := rotating.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rotating.path, i), fmt.Sprintf("%s.%d", rotating.path, i+1))
+		}
+		if err := os.Rename(rotating.path, rotating.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(rotating.path, 0); err != nil {
+		return err
+	}
+	return rotating.open()
+}
+
+func (rotating *rotatingFile) Write(data []byte) (int, error) {
+	if rotating.maxSize > 0 && rotating.size > 0 && rotating.size+int64(len(data)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rotating.file.Write(data)
+	rotating.size += int64(n)
+	return n, err
+}
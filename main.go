@@ -1,7 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/coderobe/securenet"
 )
@@ -13,49 +19,307 @@ type Event struct {
 
 type User struct {
 	Name           string
-	Password       string
-	HashedPassword []byte
-	Connected      bool
-	Bus            chan Event
+	PubKey         []byte // pinned securenet key of the user's device
+	Role           Role
+	Verified       bool // short authentication string confirmed for PubKey
+	Verifier       *ScramVerifier
+	HashedPassword []byte   // legacy bcrypt hash, replaced by Verifier on next login
+	Session        *Session // nil while the user is offline
 }
 
+// Session is a logged in user's live connection to the host
+type Session struct {
+	User    string // set once someone logs in on it
+	Remote  string
+	Started time.Time
+	Send    func(id int, event interface{}) error
+	Close   func() error
+	Pending func() int // packets queued to be written
+	// LoggedIn counts and audits a login on the session, whether the user
+	// proved who they are or had their registration approved
+	LoggedIn func(username string)
+
+	// short authentication string exchange, guarded by the host's lock
+	SasNonce  []byte   // ours, sent once the client is logged in
+	SasCommit []byte   // the client's commitment to its nonce, fixed once logged in
+	Sas       []string // words to compare, once the client revealed its nonce
+}
+
+const (
+	AuthModePassword = iota // users prove their password
+	AuthModeKey             // a pinned key alone is enough
+)
+
 type HostConfig struct {
+	ID       int    // key in Andromeda.Hosts
+	Name     string // network name, its key and audit log are kept under it
+	PubKey   []byte // key the host presents
+	listener net.Listener
+	bound    string        // address the listener got, set before the host is listed
+	done     chan struct{} // closed once the host is stopped
+
+	sync.Mutex          // guards Users
 	RegistrationEnabled bool
-	Users               []User
+	AuthMode            int
+	AdminsNeedBoth      bool   // admins must present their pinned key and password
+	MaxAuthFailures     int    // failed logins before a connection is dropped
+	PublicAddress       string // host or host:port clients reach us at, for join links
+	Logins              *LoginLimiter
+	Registrations       *RegistrationQueue
+	Invites             *InviteStore
+	Audit               *AuditLog
+	Address             string // address we were asked to listen on
+	Users               []*User
+}
+
+func (config *HostConfig) findUser(name string) *User {
+	for _, user := range config.Users {
+		if user.Name == name {
+			return user
+		}
+	}
+	return nil
 }
 
 type ClientConfig struct {
+	ID          int    // key in Andromeda.Clients
+	Profile     string // saved profile this connection was made from, if any
 	Conn        securenet.Conn
+	Server      string
+	OurPubKey   []byte
 	TheirPubKey []byte
 	Username    string
 	Password    string
+	Invite      string
+
+	sync.Mutex                                 // guards the fields below
+	Queue         *SendQueue                   // packets to send, nil until we are connected
+	Role          Role                         // what the host lets us do once logged in
+	Registrations []MessageRegistrationRequest // pending requests we may decide on
+	AdminState    *MessageAdminState           // latest members and settings from the host
 }
 
 type Andromeda struct {
 	GuiBus       chan Event
 	NetBus       chan Event
-	OurPubKey    *[]byte
-	HostConfig   *HostConfig
-	ClientConfig *ClientConfig
+	Hosts        *HostSet
+	HostDefaults HostSettings // policy new networks start out with
+	Clients      *ClientSet
+	Credentials  *CredentialStore
+	Link         *Link // simulated network conditions for debugging, nil for none
+	Limits       AcceptLimits
+	Deadlines    Deadlines
+	Queues       SendQueueConfig // how every connection buffers outgoing packets
+	Work         *WorkPool       // handshakes and password hashing for every host
+	Pending      *PendingLimiter // connections per address that haven't logged in
+	Metrics      *Metrics        // nil unless metrics are served
+	Events       *EventHub       // GUI events for control API subscribers, nil without one
+	Log          *Logger
+	ConfigDir    string
 }
 
 func main() {
-	fmt.Println("Starting Andromeda")
+	logLevel := flag.String("log-level", "info", "minimum log level (debug, info, warn, error)")
+	logJSON := flag.Bool("log-json", false, "write log lines as JSON")
+	logFile := flag.String("log-file", "", "also write logs to this file")
+	logMaxSize := flag.Int64("log-max-size", 10*1024*1024, "rotate the log file after this many bytes")
+	logMaxBackups := flag.Int("log-max-backups", 3, "number of rotated log files to keep")
+	maxAuthFailures := flag.Int("max-auth-failures", 5, "failed logins before the host drops a connection (0 for unlimited)")
+	publicAddress := flag.String("public-address", "", "host or host:port clients reach hosted networks at, for join links (default the listen address)")
+	configDir := flag.String("config-dir", "", "directory for keys and settings (default: user config dir)")
+	handshakeWorkers := flag.Int("handshake-workers", DefaultAcceptLimits.Workers, "handshakes and password checks a host runs at once")
+	handshakeQueue := flag.Int("handshake-queue", DefaultAcceptLimits.Queue, "handshakes waiting for a worker before new connections are rejected")
+	pendingPerIP := flag.Int("max-pending-per-ip", DefaultAcceptLimits.PendingPerIP, "connections from one address that haven't logged in yet (0 for unlimited)")
+	handshakeTimeout := flag.Duration("handshake-timeout", DefaultDeadlines.Handshake, "drop connections that haven't finished the key exchange by then (0 for never)")
+	authTimeout := flag.Duration("auth-timeout", DefaultDeadlines.Auth, "drop connections that haven't logged in by then after the key exchange (0 for never)")
+	idleTimeout := flag.Duration("idle-timeout", DefaultDeadlines.Idle, "drop sessions the other end has been silent on for this long (0 for never)")
+	keepalive := flag.Duration("keepalive", DefaultDeadlines.Keepalive, "ping peers this often, so hosts we joined don't think we went idle and our hosts time round trips (0 for never)")
+	sendQueue := flag.Int("send-queue", DefaultSendQueueConfig.Length, "packets of each priority buffered per connection")
+	sendTimeout := flag.Duration("send-timeout", DefaultSendQueueConfig.Timeout, "give up on a peer that takes this long to accept a packet (0 for never)")
+	slowConsumer := flag.String("slow-consumer", slowPolicyNames[DefaultSendQueueConfig.Policy], "what to do with bulk packets for a peer that isn't keeping up (drop, block, disconnect)")
+	metricsListen := flag.String("metrics-listen", "", "serve Prometheus metrics over HTTP on this address, e.g. 127.0.0.1:9273")
+	controlSocket := flag.String("control-socket", "", "serve the JSON-RPC control API on a Unix socket at this path")
+	controlMode := flag.String("control-mode", "0600", "file mode of the control socket, anyone who can write to it controls this instance")
+	headless := flag.Bool("headless", false, "run without a window, to be driven through -control-socket")
+	simulateLink := flag.String("simulate-link", "", "debug: simulate a bad link, e.g. latency=100ms,jitter=20ms,loss=0.01,bandwidth=65536,read-chunk=16,reset=4096,seed=1")
+	loadClients := flag.Int("load-test", 0, "log this many clients into a throwaway local host, print measurements and exit")
+	loadConcurrency := flag.Int("load-concurrency", 0, "logins in flight at once during -load-test (0 for all)")
+	loadLegacy := flag.Bool("load-legacy", false, "give -load-test members bcrypt password hashes")
+	loadHold := flag.Duration("load-hold", 0, "keep -load-test clients connected this long before exiting")
+	hosts := hostFlags{}
+	flag.Var(hosts, "host", "host network name=address on start, may be repeated")
+	flag.Parse()
+
+	level, err := ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	slowPolicy, err := ParseSlowPolicy(*slowConsumer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := checkPublicAddress(*publicAddress); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -public-address:", err)
+		os.Exit(2)
+	}
+	socketMode, err := strconv.ParseUint(*controlMode, 8, 32)
+	if err != nil || socketMode > 0777 {
+		fmt.Fprintln(os.Stderr, "invalid -control-mode, expected octal permissions like 0600")
+		os.Exit(2)
+	}
+
 	var state Andromeda
+	state.ConfigDir = *configDir
+	if *simulateLink != "" {
+		conditions, err := ParseLinkConditions(*simulateLink)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		state.Link = NewLink(conditions)
+	}
+	state.Log, err = NewLogger(LogConfig{
+		Level:      level,
+		JSON:       *logJSON,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxBackups: *logMaxBackups,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't open log file:", err)
+		os.Exit(1)
+	}
+	log := state.Log.With("main")
+
+	log.Info("Starting Andromeda")
+	if state.Link != nil {
+		log.Warn("Simulating a bad network link", "conditions", *simulateLink)
+	}
 	state.GuiBus = make(chan Event, 1)
 	state.NetBus = make(chan Event, 1)
-	state.OurPubKey = &[]byte{}
-	state.HostConfig = &HostConfig{}
-	state.HostConfig.RegistrationEnabled = false
-	state.ClientConfig = &ClientConfig{}
+	state.Hosts = NewHostSet()
+	state.HostDefaults = HostSettings{
+		AuthMode:        AuthModePassword,
+		MaxAuthFailures: *maxAuthFailures,
+		PublicAddress:   *publicAddress,
+	}
+	state.Clients = NewClientSet()
+	state.Credentials = &CredentialStore{}
+	state.Limits = AcceptLimits{
+		Workers:      *handshakeWorkers,
+		Queue:        *handshakeQueue,
+		PendingPerIP: *pendingPerIP,
+	}
+	state.Deadlines = Deadlines{
+		Handshake: *handshakeTimeout,
+		Auth:      *authTimeout,
+		Idle:      *idleTimeout,
+		Keepalive: *keepalive,
+	}
+	if state.Deadlines.Idle > 0 && (state.Deadlines.Keepalive == 0 || state.Deadlines.Keepalive >= state.Deadlines.Idle) {
+		log.Warn("Keepalive is not shorter than the idle timeout, quiet sessions will be dropped", "keepalive", state.Deadlines.Keepalive, "idle", state.Deadlines.Idle)
+	}
+	state.Queues = SendQueueConfig{
+		Length:  *sendQueue,
+		Timeout: *sendTimeout,
+		Policy:  slowPolicy,
+	}
+	if *metricsListen != "" {
+		state.Metrics = NewMetrics()
+	}
+	if *controlSocket != "" {
+		state.Events = NewEventHub()
+	}
+	state.Work = NewWorkPool(state.Limits.Workers, state.Limits.Queue)
+	state.Pending = NewPendingLimiter(state.Limits.PendingPerIP)
+	if state.Metrics != nil {
+		listener, err := ServeMetrics(state, *metricsListen)
+		if err != nil {
+			log.Error("Can't serve metrics", "address", *metricsListen, "error", err)
+			os.Exit(1)
+		}
+		log.Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+		if ip := net.ParseIP(remoteIP(listener.Addr())); ip == nil || !ip.IsLoopback() {
+			log.Warn("Metrics are reachable from other machines", "address", listener.Addr())
+		}
+	}
+
+	if *loadClients > 0 {
+		report, err := RunLoadTest(state, LoadTestConfig{
+			Clients:     *loadClients,
+			Concurrency: *loadConcurrency,
+			Legacy:      *loadLegacy,
+			Hold:        *loadHold,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Load test failed:", err)
+			os.Exit(1)
+		}
+		fmt.Print(report)
+		if report.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
 	state.GuiBus <- Event{
 		GuiEventShowMain,
 		GuiReqShowMain{},
 	}
+	if profiles, err := state.LoadProfiles(); err != nil {
+		log.Error("Can't load profiles", "error", err)
+	} else {
+		var autoConnect []string
+		for _, profile := range profiles.Profiles {
+			if profile.AutoConnect {
+				autoConnect = append(autoConnect, profile.Name)
+			}
+		}
+		if len(autoConnect) > 0 {
+			log.Info("Connecting saved networks", "profiles", autoConnect)
+			go func() {
+				state.GuiBus <- Event{
+					GuiEventConnectProfiles,
+					GuiReqConnectProfiles{autoConnect},
+				}
+			}()
+		}
+	}
 
-	fmt.Println("Starting NetHandle")
+	if *controlSocket != "" {
+		control, err := ServeControl(state, *controlSocket, os.FileMode(socketMode))
+		if err != nil {
+			log.Error("Can't serve control API", "path", *controlSocket, "error", err)
+			os.Exit(1)
+		}
+		defer control.Close()
+		log.Info("Serving control API", "path", *controlSocket, "mode", fmt.Sprintf("%04o", socketMode))
+		if socketMode&0002 != 0 {
+			log.Warn("Control socket is writable by everyone on this machine", "path", *controlSocket)
+		}
+	} else if *headless {
+		log.Warn("Running headless without -control-socket, nothing can drive this instance")
+	}
+
+	log.Debug("Starting NetHandle")
 	go NetHandle(state)()
-	fmt.Println("Starting GuiHandle")
+	for name, address := range hosts {
+		name, address := name, address
+		go func() {
+			state.NetBus <- Event{
+				NetEventHost,
+				NetReqHost{name, address},
+			}
+		}()
+	}
+	if *headless {
+		log.Debug("Running headless")
+		Headless(state)()
+		return
+	}
+	log.Debug("Starting GuiHandle")
 	GuiHandle(state)()
 }
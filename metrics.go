@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics keeps counters, gauges and histograms for Prometheus to scrape.
+// A nil *Metrics ignores everything, so code can report without checking
+type Metrics struct {
+	sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	kind    string // counter, gauge or histogram
+	help    string
+	buckets []float64                // upper bounds, histograms only
+	series  map[string]*metricSeries // by rendered labels
+}
+
+type metricSeries struct {
+	value  float64  // counters and gauges
+	counts []uint64 // observations per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var metricDefinitions = map[string]metricFamily{
+	"andromeda_connections":              {kind: "gauge", help: "Open connections to a host, logged in or not."},
+	"andromeda_sessions":                 {kind: "gauge", help: "Users logged in to a host."},
+	"andromeda_auth_total":               {kind: "counter", help: "Login attempts by outcome."},
+	"andromeda_registrations_total":      {kind: "counter", help: "Registration requests by what became of them."},
+	"andromeda_registrations_pending":    {kind: "gauge", help: "Registration requests waiting for a decision."},
+	"andromeda_packets_total":            {kind: "counter", help: "Packets sent and received by type."},
+	"andromeda_packet_bytes_total":       {kind: "counter", help: "Bytes sent and received by packet type."},
+	"andromeda_ping_rtt_seconds":         {kind: "histogram", help: "Round trip time of pings answered by the other end.", buckets: latencyBuckets},
+	"andromeda_handshake_seconds":        {kind: "histogram", help: "Key exchanges with new connections, including time queued for a worker.", buckets: latencyBuckets},
+	"andromeda_handshake_failures_total": {kind: "counter", help: "Connections dropped before the key exchange finished."},
+	"andromeda_handshake_queue":          {kind: "gauge", help: "Handshakes and password checks waiting for a worker."},
+	"andromeda_send_queue_pending":       {kind: "gauge", help: "Packets queued to be written to logged in users and pending registrations."},
+	"andromeda_send_dropped_total":       {kind: "counter", help: "Bulk packets given up on for peers not keeping up."},
+	"andromeda_send_disconnects_total":   {kind: "counter", help: "Peers disconnected for not keeping up."},
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{families: make(map[string]*metricFamily)}
+	for name, definition := range metricDefinitions {
+		family := definition
+		family.series = make(map[string]*metricSeries)
+		metrics.families[name] = &family
+	}
+	return metrics
+}
+
+// metricLabels renders label name, value pairs, e.g. network="home"
+func metricLabels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, pairs[i]+`="`+value+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+// series returns the series of name with labels, creating it; Metrics must be locked
+func (metrics *Metrics) series(name, labels string) (*metricFamily, *metricSeries) {
+	family := metrics.families[name]
+	if family == nil {
+		return nil, nil
+	}
+	series := family.series[labels]
+	if series == nil {
+		series = &metricSeries{counts: make([]uint64, len(family.buckets))}
+		family.series[labels] = series
+	}
+	return family, series
+}
+
+// Add adds delta to a counter or gauge
+func (metrics *Metrics) Add(name, labels string, delta float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	if _, series := metrics.series(name, labels); series != nil {
+		series.value += delta
+	}
+}
+
+// Set sets a gauge
+func (metrics *Metrics) Set(name, labels string, value float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	if _, series := metrics.series(name, labels); series != nil {
+		series.value = value
+	}
+}
+
+// Observe records value in a histogram
+func (metrics *Metrics) Observe(name, labels string, value float64) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	family, series := metrics.series(name, labels)
+	if series == nil {
+		return
+	}
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// Reset forgets every series of name, for gauges recomputed on each scrape
+func (metrics *Metrics) Reset(name string) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	if family := metrics.families[name]; family != nil {
+		family.series = make(map[string]*metricSeries)
+	}
+}
+
+// Packet counts a packet of packetID and its size going in or out
+func (metrics *Metrics) Packet(direction string, packetID int, bytes int) {
+	if metrics == nil {
+		return
+	}
+	labels := metricLabels("direction", direction, "type", packetName(packetID))
+	metrics.Add("andromeda_packets_total", labels, 1)
+	metrics.Add("andromeda_packet_bytes_total", labels, float64(bytes))
+}
+
+// Write renders every metric in the Prometheus text format
+func (metrics *Metrics) Write(w io.Writer) error {
+	if metrics == nil {
+		return nil
+	}
+	metrics.Lock()
+	defer metrics.Unlock()
+	out := bufio.NewWriter(w)
+	var names []string
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := metrics.families[name]
+		out.WriteString("# HELP " + name + " " + family.help + "\n")
+		out.WriteString("# TYPE " + name + " " + family.kind + "\n")
+		var labelSets []string
+		for labels := range family.series {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			series := family.series[labels]
+			if family.kind != "histogram" {
+				out.WriteString(name + braced(labels) + " " + formatMetric(series.value) + "\n")
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range family.buckets {
+				cumulative += series.counts[i]
+				out.WriteString(name + "_bucket" + braced(joinLabels(labels, `le="`+formatMetric(bound)+`"`)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+			}
+			out.WriteString(name + "_bucket" + braced(joinLabels(labels, `le="+Inf"`)) + " " + strconv.FormatUint(series.count, 10) + "\n")
+			out.WriteString(name + "_sum" + braced(labels) + " " + formatMetric(series.sum) + "\n")
+			out.WriteString(name + "_count" + braced(labels) + " " + strconv.FormatUint(series.count, 10) + "\n")
+		}
+	}
+	return out.Flush()
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func joinLabels(labels, more string) string {
+	if labels == "" {
+		return more
+	}
+	return labels + "," + more
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var packetNames = []string{
+	packetPing:                 "ping",
+	packetPong:                 "pong",
+	packetAuth:                 "auth",
+	packetAuthStatus:           "auth_status",
+	packetAuthChallenge:        "auth_challenge",
+	packetAuthProof:            "auth_proof",
+	packetAuthPending:          "auth_pending",
+	packetVerify:               "verify",
+	packetRegistrationRequest:  "registration_request",
+	packetRegistrationDecision: "registration_decision",
+	packetKick:                 "kick",
+	packetAdminResult:          "admin_result",
+	packetAdminQuery:           "admin_query",
+	packetAdminState:           "admin_state",
+	packetAdminSettings:        "admin_settings",
+	packetAdminSetRole:         "admin_set_role",
+	packetChat:                 "chat",
+	packetSasReveal:            "sas_reveal",
+}
+
+func packetName(packetID int) string {
+	if packetID >= 0 && packetID < len(packetNames) {
+		return packetNames[packetID]
+	}
+	return "unknown"
+}
+
+// collectMetrics refreshes the gauges that are read off the running hosts
+func (state Andromeda) collectMetrics() {
+	metrics := state.Metrics
+	metrics.Set("andromeda_handshake_queue", "", float64(state.Work.Queued()))
+	metrics.Reset("andromeda_sessions")
+	metrics.Reset("andromeda_registrations_pending")
+	metrics.Reset("andromeda_send_queue_pending")
+	for _, config := range state.Hosts.List() {
+		labels := metricLabels("network", config.Name)
+		sessions, pending := 0, 0
+		config.Lock()
+		for _, user := range config.Users {
+			if user.Session != nil {
+				sessions++
+				pending += user.Session.Pending()
+			}
+		}
+		config.Unlock()
+		registrations := config.Registrations.List()
+		for _, registration := range registrations {
+			pending += registration.Session.Pending()
+		}
+		metrics.Set("andromeda_sessions", labels, float64(sessions))
+		metrics.Set("andromeda_registrations_pending", labels, float64(len(registrations)))
+		metrics.Set("andromeda_send_queue_pending", labels, float64(pending))
+	}
+}
+
+// MetricsHandler serves state.Metrics to a Prometheus scrape
+func MetricsHandler(state Andromeda) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state.collectMetrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		state.Metrics.Write(w)
+	})
+}
+
+// ServeMetrics listens on address and serves metrics under /metrics until
+// the listener is closed
+func ServeMetrics(state Andromeda, address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler(state))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return listener, nil
+}
+
+// meteredReader counts the bytes read through it, so a packet's size is
+// known once it has been decoded
+type meteredReader struct {
+	r interface {
+		io.Reader
+		io.ByteReader
+	}
+	n int
+}
+
+func (reader *meteredReader) Read(p []byte) (int, error) {
+	n, err := reader.r.Read(p)
+	reader.n += n
+	return n, err
+}
+
+func (reader *meteredReader) ReadByte() (byte, error) {
+	c, err := reader.r.ReadByte()
+	if err == nil {
+		reader.n++
+	}
+	return c, err
+}
+
+func (reader *meteredReader) UnreadByte() error {
+	scanner, ok := reader.r.(io.ByteScanner)
+	if !ok {
+		return errors.New("can't unread")
+	}
+	err := scanner.UnreadByte()
+	if err == nil {
+		reader.n--
+	}
+	return err
+}
+
+// take returns the bytes read since it was last called
+func (reader *meteredReader) take() int {
+	n := reader.n
+	reader.n = 0
+	return n
+}
+
+type meteredWriter struct {
+	w io.Writer
+	n int
+}
+
+func (writer *meteredWriter) Write(p []byte) (int, error) {
+	n, err := writer.w.Write(p)
+	writer.n += n
+	return n, err
+}
+
+func (writer *meteredWriter) take() int {
+	n := writer.n
+	writer.n = 0
+	return n
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Add("andromeda_auth_total", metricLabels("network", `we "quote"`, "outcome", "success"), 2)
+	metrics.Set("andromeda_handshake_queue", "", 3)
+	metrics.Observe("andromeda_handshake_seconds", metricLabels("network", "home"), 0.003)
+	metrics.Observe("andromeda_handshake_seconds", metricLabels("network", "home"), 20)
+	metrics.Add("andromeda_no_such_metric", "", 1)
+
+	var b strings.Builder
+	if err := metrics.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE andromeda_auth_total counter",
+		`andromeda_auth_total{network="we \"quote\"",outcome="success"} 2`,
+		"andromeda_handshake_queue 3",
+		"# TYPE andromeda_handshake_seconds histogram",
+		`andromeda_handshake_seconds_bucket{network="home",le="0.0025"} 0`,
+		`andromeda_handshake_seconds_bucket{network="home",le="0.005"} 1`,
+		`andromeda_handshake_seconds_bucket{network="home",le="10"} 1`,
+		`andromeda_handshake_seconds_bucket{network="home",le="+Inf"} 2`,
+		`andromeda_handshake_seconds_sum{network="home"} 20.003`,
+		`andromeda_handshake_seconds_count{network="home"} 2`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q in\n%s", line, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "andromeda_no_such_metric") {
+		t.Error("undefined metric was written")
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var metrics *Metrics
+	metrics.Add("andromeda_auth_total", "", 1)
+	metrics.Observe("andromeda_ping_rtt_seconds", "", 1)
+	metrics.Packet("in", packetPing, 10)
+	if err := metrics.Write(&strings.Builder{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsScrape(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Metrics = NewMetrics()
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	network.waitLoggedIn("alice")
+	network.join("alice", "wrong horse")
+	network.waitMessage("Authentication failure")
+
+	recorder := httptest.NewRecorder()
+	MetricsHandler(network.state).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`andromeda_sessions{network="test"} 1`,
+		`andromeda_auth_total{network="test",outcome="success"} 1`,
+		`andromeda_auth_total{network="test",outcome="failure"} 1`,
+		`andromeda_handshake_seconds_count{network="test"} 2`,
+		`andromeda_packets_total{direction="in",type="auth"} 2`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	if !strings.Contains(body, `andromeda_ping_rtt_seconds_count{side="host",network="test"}`) {
+		t.Errorf("no host ping round trips in\n%s", body)
+	}
+}
+
+func TestHostPingsPeriodically(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Metrics = NewMetrics()
+		state.Deadlines.Keepalive = 20 * time.Millisecond
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	network.waitLoggedIn("alice")
+
+	network.waitUntil("several host round trips", func() bool {
+		var b strings.Builder
+		network.state.Metrics.Write(&b)
+		for _, line := range strings.Split(b.String(), "\n") {
+			if count := strings.TrimPrefix(line, `andromeda_ping_rtt_seconds_count{side="host",network="test"} `); count != line {
+				samples, _ := strconv.Atoi(count)
+				return samples >= 3
+			}
+		}
+		return false
+	})
+}
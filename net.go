@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/coderobe/securenet"
 	"github.com/vmihailenco/msgpack/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -16,299 +21,1580 @@ const (
 	NetEventRegistration
 	NetEventJoin
 	NetEventJoinUnknownConnection
+	NetEventVerify
+	NetEventKick
+	NetEventRemoteRegistration
+	NetEventRemoteKick
+	NetEventSetRole
+	NetEventRemoteQuery
+	NetEventRemoteSettings
+	NetEventRemoteRole
+	NetEventLeave
+	NetEventStopHost
+	NetEventChat
+	NetEventSettings
 )
 
 type NetReqHost struct {
+	Name   string
 	Server string
 }
+type NetReqStopHost struct {
+	Host int
+}
 type NetReqRegistration struct {
-	Username string
-	Password string
-	Allow    bool
-	Send     interface{}
+	Host  int
+	ID    int
+	Allow bool
 }
 type NetReqJoin struct {
+	Profile  string // saved profile this join was started from, if any
 	Server   string
 	Username string
 	Password string
+	Identity string
+	HostKey  []byte // expected host key from a join link or typed fingerprint, skips manual confirmation
+	Invite   string
 }
 type NetReqJoinUnknownConnection struct {
-	Allow bool
+	Client int
+	Allow  bool
+}
+type NetReqKick struct {
+	Host     int
+	Username string
+	Reason   string
+}
+type NetReqSetRole struct {
+	Host     int
+	Username string
+	Role     Role
+}
+type NetReqRemoteRegistration struct {
+	Client int
+	ID     int
+	Allow  bool
+}
+type NetReqRemoteKick struct {
+	Client   int
+	Username string
+	Reason   string
+}
+type NetReqRemoteRole struct {
+	Client   int
+	Username string
+	Role     Role
+}
+type NetReqRemoteQuery struct {
+	Client int
+}
+type NetReqSettings struct {
+	Host     int
+	Settings HostSettings
+}
+type NetReqRemoteSettings struct {
+	Client   int
+	Settings HostSettings
+}
+type NetReqLeave struct {
+	Client int
+}
+type NetReqChat struct {
+	Host   int // network to chat on as its host
+	Client int // network we joined to chat on, instead of Host
+	Text   string
+}
+type NetReqVerify struct {
+	Host     int    // network the verified user is on, when we're hosting
+	Client   int    // network we verified the host of, when we're the client
+	Username string // user whose session the host verified, empty when we're the client
+	Match    bool
 }
 
 const (
-	packetPing       = iota
-	packetPong       = iota
-	packetAuth       = iota
-	packetAuthStatus = iota
+	packetPing                 = iota
+	packetPong                 = iota
+	packetAuth                 = iota
+	packetAuthStatus           = iota
+	packetAuthChallenge        = iota
+	packetAuthProof            = iota
+	packetAuthPending          = iota
+	packetVerify               = iota
+	packetRegistrationRequest  = iota
+	packetRegistrationDecision = iota
+	packetKick                 = iota
+	packetAdminResult          = iota
+	packetAdminQuery           = iota
+	packetAdminState           = iota
+	packetAdminSettings        = iota
+	packetAdminSetRole         = iota
+	packetChat                 = iota
+	packetSasReveal            = iota
 )
 
+const maxChatLength = 4096
+
 type MessagePing struct {
 	Token string
 }
 type MessagePong MessagePing
 type MessageAuth struct {
-	Username string
-	Password string
+	Username  string
+	Nonce     []byte
+	Invite    string
+	SasCommit []byte // sasCommitment of the nonce sent in MessageSasReveal
+}
+type MessageAuthChallenge struct {
+	Salt       []byte
+	Iterations int
+	Nonce      []byte
+	Register   bool   // unknown user, proof must carry a verifier to register with
+	Bcrypt     string // user only has a legacy bcrypt hash, see legacy.go
+}
+type MessageAuthProof struct {
+	Proof    []byte
+	Verifier *ScramVerifier
+}
+type MessageAuthPending struct {
+	Expires int // seconds the host keeps the request open
+}
+type MessageSasReveal struct {
+	Nonce []byte // sent once logged in, after the host's nonce arrived
+}
+type MessageVerify struct {
+	Match bool // the sender compared the short authentication string
 }
 type MessageAuthStatus struct {
-	Success bool
+	Success         bool
+	ServerSignature []byte
+	RetryAfter      int    // seconds until the host accepts another attempt
+	SasNonce        []byte // the host's share of the short authentication string
+	Role            Role
+}
+type MessageRegistrationRequest struct {
+	ID       int
+	Username string
+	PubKey   []byte
+	Remote   string
+	Expires  time.Time
+}
+type MessageRegistrationDecision struct {
+	ID    int
+	Allow bool // from the host: how the request was settled
+}
+type MessageKick struct {
+	Username string // who to kick, or from the host: who kicked us
+	Reason   string
+}
+type MessageAdminResult struct {
+	Action string
+	Error  string // empty if the action was carried out
+}
+type MessageAdminQuery struct {
+}
+type MessageAdminState struct {
+	Members  []MemberInfo
+	Settings HostSettings
+}
+type MessageAdminSettings struct {
+	Settings HostSettings
+}
+type MessageAdminSetRole struct {
+	Username string
+	Role     Role
+}
+type MessageChat struct {
+	From string // set by the host, empty for the host itself
+	Text string
+}
+
+// hostAuthAttempt is the challenge a host connection is waiting on a proof for
+type hostAuthAttempt struct {
+	Username    string
+	Invite      string
+	Challenge   MessageAuthChallenge
+	AuthMessage []byte
 }
 
 func NetHandle(state Andromeda) func() {
 	channel := state.NetBus
+	log := state.Log.With("net")
 
 	return func() {
-		for {
-			request := <-channel
-			fmt.Printf("Handling Net event request %d\n", request.ID)
+		for request := range channel {
+			request := request
+			log.Debug("Handling Net event request", "id", request.ID)
 			switch id := request.ID; id {
 			case NetEventHost:
 				go func() {
-					fmt.Println("Trying to host on", request.Event.(NetReqHost).Server)
-
-					listener, err := net.Listen("tcp", request.Event.(NetReqHost).Server)
+					host := request.Event.(NetReqHost)
+					log.Info("Trying to host", "network", host.Name, "address", host.Server)
+					config, err := state.StartHost(host.Name, host.Server)
 					if err != nil {
-						fmt.Println("Can't listen")
+						log.Error("Can't host", "network", host.Name, "address", host.Server, "error", err)
+						state.GuiBus <- Event{
+							GuiEventShowMessage,
+							GuiReqShowMessage{"Host", "Can't host '" + host.Name + "' on " + host.Server + ":\n" + err.Error()},
+						}
 						return
 					}
-
-					pub, priv, elligator, err := securenet.GenerateKeys() // todo: load from config
-					if err != nil {
-						fmt.Println("Failed to generate host keys")
+					state.GuiBus <- Event{
+						GuiEventShowHostReady,
+						GuiReqShowHostReady{config.ID},
+					}
+				}()
+			case NetEventStopHost:
+				go func() {
+					config := state.Hosts.Get(request.Event.(NetReqStopHost).Host)
+					if config == nil {
 						return
 					}
-
-					*state.OurPubKey = pub[:]
-					fmt.Println(state.OurPubKey)
+					log.Info("Stopping host", "network", config.Name)
+					state.StopHost(config)
 					state.GuiBus <- Event{
-						GuiEventShowHostReady,
-						GuiReqShowHostReady{},
+						GuiEventClientsChanged,
+						GuiReqClientsChanged{},
 					}
-
-					for {
-						pConn, err := listener.Accept()
-						if err != nil {
-							continue
+				}()
+			case NetEventRegistration:
+				go func() {
+					registration := request.Event.(NetReqRegistration)
+					config := state.Hosts.Get(registration.Host)
+					if config == nil {
+						return
+					}
+					if err := decideRegistration(state, config, log, registration.ID, registration.Allow, ""); err != nil {
+						log.Warn("Can't decide registration", "network", config.Name, "id", registration.ID, "error", err)
+					}
+				}()
+			case NetEventKick:
+				go func() {
+					kick := request.Event.(NetReqKick)
+					config := state.Hosts.Get(kick.Host)
+					if config == nil {
+						return
+					}
+					if err := kickUser(state, config, log, kick.Username, "", kick.Reason); err != nil {
+						state.GuiBus <- Event{
+							GuiEventShowAlert,
+							GuiReqShowAlert{"Kick", err.Error()},
 						}
-						fmt.Println("Got new connection")
-						go func() {
-							conn, err := securenet.WrapWithKeys(pConn, pub, priv, elligator)
-							if err != nil {
-								return
-							}
-							var sentPing MessagePing // hold on to last ping we sent for pong
-							sendMessage := boundSendMessage(msgpack.NewEncoder(conn), conn)
-							decoder := msgpack.NewDecoder(conn)
-
-							sentPing.Token = "Foo, bar!"
-							fmt.Println("Sending ping")
-							sendMessage(packetPing, sentPing)
-							fmt.Println("Sent ping")
-
-							for {
-								messageByte, err := conn.ReadByte()
-								if err != nil {
-									var netErr net.Error
-									if errors.As(err, &netErr) {
-										if netErr.Timeout() {
-											fmt.Println("Read timed out")
-											continue
-										}
-									}
-									return
-								}
-								switch messageType := uint8(messageByte); messageType {
-								case packetPing:
-									var ping MessagePing
-									decoder.Decode(&ping)
-
-									fmt.Printf("Got ping, token is '%s'\n", ping.Token)
-									sendMessage(packetPong, ping) // return as pong
-								case packetPong:
-									var pong MessagePong
-									decoder.Decode(&pong)
-									fmt.Printf("Got pong, token is '%s', matches? %b\n", pong.Token, sentPing.Token == pong.Token)
-								case packetAuth:
-									var auth MessageAuth
-									decoder.Decode(&auth)
-									fmt.Printf("Got user auth attempt for '%s'\n", auth.Username)
-									var authStatus MessageAuthStatus
-									authStatus.Success = false
-
-									userExists := false
-									for _, user := range state.HostConfig.Users {
-										if user.Name == auth.Username {
-											// User exists
-											userExists = true
-											if bcrypt.CompareHashAndPassword(user.HashedPassword, []byte(auth.Password)) == nil {
-												// Password correct
-												authStatus.Success = true
-												user.Bus = make(chan Event)
-												go func() {
-													for {
-														message := <-user.Bus
-														sendMessage(message.ID, message.Event)
-													}
-												}()
-												state.GuiBus <- Event{
-													GuiEventShowHostReady,
-													GuiReqShowHostReady{},
-												}
-											}
-											sendMessage(packetAuthStatus, authStatus)
-											break
-										}
-									}
-									fmt.Println(state.HostConfig.RegistrationEnabled)
-									if !userExists && state.HostConfig.RegistrationEnabled {
-										state.GuiBus <- Event{
-											GuiEventShowHostUnknownConnection,
-											GuiReqShowHostUnknownConnection{
-												conn.GetServerPublicKey()[:],
-												auth.Username,
-												auth.Password,
-												sendMessage,
-											},
-										}
-									}
-								default:
-									fmt.Printf("Unknown packet of type %d incoming\n", messageType)
-								}
-							}
-						}()
 					}
 				}()
-			case NetEventRegistration:
+			case NetEventRemoteRegistration:
 				go func() {
-					var authStatus MessageAuthStatus
-					var newUser User
-					hashedPw, err := bcrypt.GenerateFromPassword([]byte(request.Event.(NetReqRegistration).Password), 10)
-					if err != nil {
-						authStatus.Success = false
+					remote := request.Event.(NetReqRemoteRegistration)
+					state.Clients.Send(remote.Client, packetRegistrationDecision, MessageRegistrationDecision{remote.ID, remote.Allow})
+				}()
+			case NetEventSetRole:
+				go func() {
+					setRole := request.Event.(NetReqSetRole)
+					config := state.Hosts.Get(setRole.Host)
+					if config == nil {
+						return
+					}
+					action := AdminAction{Action: "set role " + setRole.Role.String(), Target: setRole.Username}
+					if err := config.SetRole(setRole.Username, setRole.Role, ""); err != nil {
+						action.Error = err.Error()
+					}
+					recordAdmin(state, config, action)
+				}()
+			case NetEventSettings:
+				go func() {
+					change := request.Event.(NetReqSettings)
+					config := state.Hosts.Get(change.Host)
+					if config == nil {
+						return
+					}
+					action := AdminAction{Action: "change settings", Target: fmt.Sprintf("%+v", change.Settings)}
+					if err := config.ApplySettings(change.Settings); err != nil {
+						action.Error = err.Error()
 					} else {
-						authStatus.Success = true
-						newUser.Name = request.Event.(NetReqRegistration).Username
-						newUser.HashedPassword = hashedPw
-						newUser.Bus = make(chan Event)
-						sendMessage := request.Event.(NetReqRegistration).Send.(func(id int, event interface{}) error)
-						go func() {
-							for {
-								message := <-newUser.Bus
-								sendMessage(message.ID, message.Event)
-							}
-						}()
-						fmt.Println("Adding User to user list")
-						state.HostConfig.Users = append(state.HostConfig.Users, newUser)
+						state.GuiBus <- Event{
+							GuiEventHostChanged,
+							GuiReqHostChanged{config.ID},
+						}
 					}
-					request.Event.(NetReqRegistration).Send.(func(id int, event interface{}) error)(packetAuthStatus, authStatus)
-					state.GuiBus <- Event{
-						GuiEventShowHostReady,
-						GuiReqShowHostReady{},
+					recordAdmin(state, config, action)
+				}()
+			case NetEventRemoteQuery:
+				go func() {
+					state.Clients.Send(request.Event.(NetReqRemoteQuery).Client, packetAdminQuery, MessageAdminQuery{})
+				}()
+			case NetEventRemoteSettings:
+				go func() {
+					remote := request.Event.(NetReqRemoteSettings)
+					state.Clients.Send(remote.Client, packetAdminSettings, MessageAdminSettings{remote.Settings})
+				}()
+			case NetEventRemoteRole:
+				go func() {
+					remote := request.Event.(NetReqRemoteRole)
+					state.Clients.Send(remote.Client, packetAdminSetRole, MessageAdminSetRole{remote.Username, remote.Role})
+				}()
+			case NetEventRemoteKick:
+				go func() {
+					remote := request.Event.(NetReqRemoteKick)
+					state.Clients.Send(remote.Client, packetKick, MessageKick{remote.Username, remote.Reason})
+				}()
+			case NetEventChat:
+				go func() {
+					chat := request.Event.(NetReqChat)
+					if chat.Client != 0 {
+						state.Clients.Send(chat.Client, packetChat, MessageChat{Text: chat.Text})
+						return
+					}
+					if config := state.Hosts.Get(chat.Host); config != nil {
+						broadcastChat(state, config, MessageChat{"", chat.Text})
+					}
+				}()
+			case NetEventLeave:
+				go func() {
+					if client := state.Clients.Get(request.Event.(NetReqLeave).Client); client != nil {
+						log.Info("Leaving network", "address", client.Server)
+						client.Close()
 					}
 				}()
 			case NetEventJoin:
 				go func() {
-					fmt.Println("Trying to join", request.Event.(NetReqJoin).Server)
-
-					fmt.Println("as", request.Event.(NetReqJoin).Username)
-					state.ClientConfig.Username = request.Event.(NetReqJoin).Username
+					join := request.Event.(NetReqJoin)
+					log.Info("Trying to join", "address", join.Server, "user", join.Username, "profile", join.Profile)
+					client := &ClientConfig{
+						Profile:  join.Profile,
+						Server:   join.Server,
+						Username: join.Username,
+						Password: join.Password,
+						Invite:   join.Invite,
+					}
 
-					fmt.Println("authenticated by", request.Event.(NetReqJoin).Password)
-					state.ClientConfig.Password = request.Event.(NetReqJoin).Password
+					identity, err := state.LoadIdentity(join.Identity)
+					if err != nil {
+						log.Error("Can't load identity", "identity", join.Identity, "error", err)
+						state.GuiBus <- Event{
+							GuiEventShowMessage,
+							GuiReqShowMessage{"Join", "Can't load identity: " + err.Error()},
+						}
+						return
+					}
 
-					conn, err := securenet.Dial("tcp", request.Event.(NetReqJoin).Server)
-					state.ClientConfig.Conn = conn
+					conn, err := identity.Dial(join.Server, state.Link, state.Deadlines.Handshake)
 					if err != nil {
-						fmt.Println("Failed to connect")
+						log.Error("Failed to connect", "address", join.Server, "error", err)
+						state.GuiBus <- Event{
+							GuiEventShowMessage,
+							GuiReqShowMessage{"Join", "Can't connect to " + join.Server + ":\n" + err.Error()},
+						}
 						return
 					}
+					client.Conn = conn
+					client.OurPubKey = conn.GetPublicKey()[:]
+					client.TheirPubKey = conn.GetServerPublicKey()[:]
+					id := state.Clients.Add(client)
 
-					*state.OurPubKey = state.ClientConfig.Conn.GetPublicKey()[:]
-					state.ClientConfig.TheirPubKey = state.ClientConfig.Conn.GetServerPublicKey()[:]
+					if expected := join.HostKey; expected != nil {
+						if !bytes.Equal(expected, client.TheirPubKey) {
+							log.Error("Host key does not match the expected key", "address", join.Server, "pubkey", client.TheirPubKey)
+							conn.Close()
+							state.Clients.Remove(id)
+							state.GuiBus <- Event{
+								GuiEventShowMessage,
+								GuiReqShowMessage{"Join", "The host presented a different key than expected!\nYour connection might be intercepted."},
+							}
+							return
+						}
+						log.Info("Host key matches the expected key", "address", join.Server)
+						state.NetBus <- Event{
+							NetEventJoinUnknownConnection,
+							NetReqJoinUnknownConnection{id, true},
+						}
+						return
+					}
+					known, pinned := state.KnownHost(client.Server)
+					if pinned && known.Verified && bytes.Equal(known.HostKey, client.TheirPubKey) {
+						log.Info("Host key matches verified pin", "address", client.Server)
+						state.NetBus <- Event{
+							NetEventJoinUnknownConnection,
+							NetReqJoinUnknownConnection{id, true},
+						}
+						return
+					}
+					if pinned && !bytes.Equal(known.HostKey, client.TheirPubKey) {
+						log.Warn("Host key changed since last connection", "address", client.Server, "pubkey", client.TheirPubKey)
+					}
 					state.GuiBus <- Event{
 						GuiEventShowJoinUnknownConnection,
-						GuiReqShowJoinUnknownConnection{},
+						GuiReqShowJoinUnknownConnection{
+							id,
+							pinned && !bytes.Equal(known.HostKey, client.TheirPubKey),
+						},
 					}
 				}()
 			case NetEventJoinUnknownConnection:
 				go func() {
+					client := state.Clients.Get(request.Event.(NetReqJoinUnknownConnection).Client)
+					if client == nil {
+						return
+					}
 					if !request.Event.(NetReqJoinUnknownConnection).Allow {
-						fmt.Println("Connection abort")
+						log.Info("Connection aborted by user", "address", client.Server)
+						client.Conn.Close()
+						state.Clients.Remove(client.ID)
 						return
 					}
 
+					if err := state.PinHost(client.Server, client.TheirPubKey, false); err != nil {
+						log.Warn("Can't pin host key", "address", client.Server, "error", err)
+					}
+					if client.Profile != "" {
+						if err := state.pinProfileHost(client.Profile, client.TheirPubKey); err != nil {
+							log.Warn("Can't store host key in profile", "profile", client.Profile, "error", err)
+						}
+					}
 					state.GuiBus <- Event{
 						GuiEventShowJoinOurHostKey,
-						GuiReqShowJoinOurHostKey{},
-					}
-
-					var sentPing MessagePing // hold on to last ping we sent for pong
-					sendMessage := boundSendMessage(msgpack.NewEncoder(state.ClientConfig.Conn), state.ClientConfig.Conn)
-					decoder := msgpack.NewDecoder(state.ClientConfig.Conn)
-
-					var auth MessageAuth
-					auth.Username = state.ClientConfig.Username
-					auth.Password = state.ClientConfig.Password
-					sendMessage(packetAuth, auth)
-
-					for {
-						messageByte, err := state.ClientConfig.Conn.ReadByte()
-						if err != nil {
-							var netErr net.Error
-							if errors.As(err, &netErr) {
-								if netErr.Timeout() {
-									fmt.Println("Read timed out")
-									continue
-								}
-							}
+						GuiReqShowJoinOurHostKey{client.ID},
+					}
+					state.GuiBus <- Event{
+						GuiEventClientsChanged,
+						GuiReqClientsChanged{},
+					}
+					handleClientConnection(state, log, client)
+					state.Clients.Remove(client.ID)
+					state.GuiBus <- Event{
+						GuiEventClientsChanged,
+						GuiReqClientsChanged{},
+					}
+				}()
+			case NetEventVerify:
+				go func() {
+					verify := request.Event.(NetReqVerify)
+					if verify.Username == "" {
+						client := state.Clients.Get(verify.Client)
+						if client == nil {
 							return
 						}
-						switch messageType := uint8(messageByte); messageType {
-						case packetPing:
-							var ping MessagePing
-							decoder.Decode(&ping)
-
-							fmt.Printf("Got ping, token is '%s'\n", ping.Token)
-							sendMessage(packetPong, ping) // return as pong
-						case packetPong:
-							var pong MessagePong
-							decoder.Decode(&pong)
-							fmt.Printf("Got pong, token is '%s', matches? %b\n", pong.Token, sentPing.Token == pong.Token)
-						case packetAuthStatus:
-							var authStatus MessageAuthStatus
-							decoder.Decode(&authStatus)
-							if authStatus.Success {
-								println("Auth success")
-								state.GuiBus <- Event{
-									GuiEventShowMessage,
-									GuiReqShowMessage{"Join", "Authentication success"},
-								}
-							} else {
-								println("Auth fail")
-								state.GuiBus <- Event{
-									GuiEventShowMessage,
-									GuiReqShowMessage{"Join", "Authentication failure"},
-								}
+						log.Info("Compared short authentication string with host", "address", client.Server, "match", verify.Match)
+						if verify.Match {
+							if err := state.PinHost(client.Server, client.TheirPubKey, true); err != nil {
+								log.Warn("Can't store host verification", "address", client.Server, "error", err)
+							}
+						}
+						state.Clients.Send(client.ID, packetVerify, MessageVerify{verify.Match})
+						if !verify.Match {
+							client.Close()
+							state.GuiBus <- Event{
+								GuiEventShowMessage,
+								GuiReqShowMessage{"Join", "Verification words did not match, disconnected.\nYour connection might be intercepted."},
 							}
-						default:
-							fmt.Printf("Unknown packet of type %d incoming\n", messageType)
 						}
+						return
+					}
+
+					config := state.Hosts.Get(verify.Host)
+					if config == nil {
+						return
+					}
+					log.Info("Compared short authentication string with user", "network", config.Name, "user", verify.Username, "match", verify.Match)
+					audit(state, config, AuditEvent{Kind: AuditVerify, Username: verify.Username, Detail: fmt.Sprintf("host compared words, match=%t", verify.Match)})
+					var session *Session
+					config.Lock()
+					if user := config.findUser(verify.Username); user != nil {
+						user.Verified = verify.Match
+						session = user.Session
+					}
+					config.Unlock()
+					if session != nil {
+						session.Send(packetVerify, MessageVerify{verify.Match})
 					}
 				}()
 			default:
-				fmt.Printf("Fatal: Unknown Net event %d, this should not have happened\n", id)
+				log.Error("Fatal: Unknown Net event, this should not have happened", "id", id)
 				os.Exit(1)
 			}
 		}
-		fmt.Println("NetHandle stopped")
+		log.Info("NetHandle stopped")
 	}
 }
 
-func boundSendMessage(encoder *msgpack.Encoder, conn net.Conn) func(packetID int, message interface{}) (err error) {
+func handleHostConnection(state Andromeda, config *HostConfig, log *Logger, conn securenet.Conn) {
+	remote := conn.RemoteAddr()
+	var sentPing MessagePing     // hold on to last ping we sent for pong
+	var pending *hostAuthAttempt // challenge we expect a proof for
+	queue := NewSendQueue(conn, state.Queues, log, state.Metrics)
+	sendMessage := queue.Send
+	reader := &meteredReader{r: conn}
+	decoder := msgpack.NewDecoder(reader)
+	session := &Session{
+		Remote:   remote.String(),
+		Started:  time.Now(),
+		Send:     queue.Send,
+		Close:    queue.Close,
+		Pending:  queue.Pending,
+		SasNonce: randomBytes(sasNonceSize),
+	}
+	metricNetwork := metricLabels("network", config.Name)
+	state.Metrics.Add("andromeda_connections", metricNetwork, 1)
+	defer func() {
+		state.Metrics.Add("andromeda_connections", metricNetwork, -1)
+		queue.Close()
+		config.Lock()
+		if user := config.findUser(session.User); user != nil && user.Session == session {
+			user.Session = nil
+		}
+		config.Unlock()
+	}()
+
+	ip := remoteIP(remote)
+	var released sync.Once // the connection no longer counts as pending once logged in
+	releasePending := func() {
+		released.Do(func() { state.Pending.Release(ip) })
+	}
+	defer releasePending()
+	session.LoggedIn = func(username string) {
+		state.Metrics.Add("andromeda_auth_total", metricLabels("network", config.Name, "outcome", "success"), 1)
+		releasePending()
+		audit(state, config, AuditEvent{Kind: AuditLogin, Username: username, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: session.Remote})
+	}
+	loggedIn := false
+	authFailures := 0
+	// countFailure counts a failed login on this connection; false means
+	// there have been too many and it has to be dropped
+	countFailure := func() bool {
+		authFailures++
+		// settings can be changed by a remote admin at any time
+		if max := config.Settings().MaxAuthFailures; max > 0 && authFailures >= max {
+			log.Warn("Too many failed logins, disconnecting", "remote", remote, "failures", authFailures)
+			return false
+		}
+		return true
+	}
+	// reportAuth tells the client how its login went and feeds failures to
+	// the rate limiter; false means this connection has to be dropped
+	reportAuth := func(username string, authStatus MessageAuthStatus, reason string) bool {
+		log.Info("User auth result", "remote", remote, "user", username, "success", authStatus.Success, "reason", reason)
+		if authStatus.Success {
+			if !loggedIn {
+				loggedIn = true
+				setReadTimeout(conn, state.Deadlines.Idle)
+			}
+			session.LoggedIn(username)
+			config.Logins.Success(username)
+			_, authStatus.Role, _ = config.sessionRole(session)
+			authStatus.SasNonce = session.SasNonce
+			sendMessage(packetAuthStatus, authStatus)
+			if authStatus.Role.Can(PermissionApproveRegistrations) {
+				for _, registration := range config.Registrations.List() {
+					sendMessage(packetRegistrationRequest, registration.Message())
+				}
+			}
+			if authStatus.Role.Can(PermissionViewMembers) {
+				sendMessage(packetAdminState, adminState(config))
+			}
+			state.GuiBus <- Event{
+				GuiEventHostChanged,
+				GuiReqHostChanged{config.ID},
+			}
+			return true
+		}
+		state.Metrics.Add("andromeda_auth_total", metricLabels("network", config.Name, "outcome", "failure"), 1)
+		// failures are audited one by one only until they cause a lockout,
+		// and attempts during one not at all, so guessing can't grow the
+		// audit log faster than lockouts allow
+		if lockout := config.Logins.Failure(ip, username, reason); lockout == 0 {
+			audit(state, config, AuditEvent{Kind: AuditLoginFailed, Username: username, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: session.Remote, Detail: reason})
+		} else {
+			log.Warn("Locking out logins", "remote", remote, "user", username, "duration", lockout)
+			audit(state, config, AuditEvent{Kind: AuditLockout, Username: username, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: ip, Detail: lockout.String() + " after " + reason})
+			authStatus.RetryAfter = int(lockout.Seconds())
+			state.GuiBus <- Event{
+				GuiEventHostChanged,
+				GuiReqHostChanged{config.ID},
+			}
+			if lockouts := config.Logins.Alert(); lockouts > 0 {
+				state.GuiBus <- Event{
+					GuiEventShowAlert,
+					GuiReqShowAlert{
+						"Failed logins",
+						fmt.Sprintf("%d lockouts for repeated failed logins, latest '%s' from %s.\nFurther lockouts are counted on the host screen.", lockouts, username, ip),
+					},
+				}
+			}
+		}
+		sendMessage(packetAuthStatus, authStatus)
+		return countFailure()
+	}
+
+	var registrationID int // our request in the registration queue, if any
+	defer func() {
+		if registrationID != 0 && config.Registrations.Take(registrationID) != nil {
+			log.Info("Withdrew registration request of closed connection", "remote", remote)
+			state.Metrics.Add("andromeda_registrations_total", metricLabels("network", config.Name, "outcome", "withdrawn"), 1)
+			audit(state, config, AuditEvent{Kind: AuditRegistrationWithdrawn, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: session.Remote, Detail: "connection closed"})
+			notifyPermitted(config, PermissionApproveRegistrations, packetRegistrationDecision, MessageRegistrationDecision{registrationID, false})
+			state.GuiBus <- Event{
+				GuiEventHostChanged,
+				GuiReqHostChanged{config.ID},
+			}
+		}
+	}()
+	requestRegistration := func(username string, verifier *ScramVerifier) {
+		if registrationID != 0 && config.Registrations.Take(registrationID) != nil {
+			notifyPermitted(config, PermissionApproveRegistrations, packetRegistrationDecision, MessageRegistrationDecision{registrationID, false})
+		}
+		registration := &PendingRegistration{
+			Username: username,
+			PubKey:   conn.GetServerPublicKey()[:],
+			Verifier: verifier,
+			Time:     time.Now(),
+			Session:  session,
+		}
+		registrationID = config.Registrations.Add(registration)
+		state.Metrics.Add("andromeda_registrations_total", metricLabels("network", config.Name, "outcome", "requested"), 1)
+		setReadTimeout(conn, state.Deadlines.Idle)
+		log.Info("Queued registration request", "remote", remote, "user", username, "id", registrationID)
+		audit(state, config, AuditEvent{Kind: AuditRegistrationRequested, Username: username, Key: auditKey(registration.PubKey), Remote: session.Remote})
+		sendMessage(packetAuthPending, MessageAuthPending{int(registrationTTL.Seconds())})
+		state.GuiBus <- Event{
+			GuiEventHostChanged,
+			GuiReqHostChanged{config.ID},
+		}
+		notifyPermitted(config, PermissionApproveRegistrations, packetRegistrationRequest, registration.Message())
+	}
+
+	// adminAction authorizes a remote admin request against permission, runs
+	// it, records the outcome and reports it back
+	adminAction := func(action, target string, permission Permission, run func(by string) error) {
+		name, role, ok := config.sessionRole(session)
+		var err error
+		switch {
+		case !ok:
+			err = errors.New("not logged in")
+		case !role.Can(permission):
+			err = fmt.Errorf("role '%s' may not %s", role, action)
+		default:
+			err = run(name)
+		}
+		record := AdminAction{Username: name, Remote: session.Remote, Action: action, Target: target}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		recordAdmin(state, config, record)
+		sendMessage(packetAdminResult, MessageAdminResult{action, record.Error})
+		if err == nil && role.Can(PermissionViewMembers) {
+			sendMessage(packetAdminState, adminState(config))
+		}
+	}
+
+	// pinged at connect and then as often as clients send keepalives, for
+	// round trip times; unix nanoseconds of the ping awaiting its pong
+	sentPing.Token = "Foo, bar!"
+	var pingSent int64
+	ping := func() error {
+		log.Debug("Sending ping", "remote", remote)
+		atomic.CompareAndSwapInt64(&pingSent, 0, time.Now().UnixNano())
+		return sendMessage(packetPing, sentPing)
+	}
+	ping()
+	if interval := state.Deadlines.Keepalive; interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-queue.Done():
+					return
+				case <-ticker.C:
+				}
+				if ping() == ErrSendQueueClosed {
+					return
+				}
+			}
+		}()
+	}
+
+	setReadTimeout(conn, state.Deadlines.Auth)
+	for {
+		packetID, packet, err := readPacket(reader, decoder)
+		if err != nil {
+			var packetErr *PacketError
+			var netErr net.Error
+			if errors.As(err, &packetErr) {
+				log.Warn("Malformed packet, disconnecting", "remote", remote, "type", packetErr.ID, "error", packetErr.Err)
+				return
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if loggedIn || registrationID != 0 {
+					log.Info("Reaping idle session", "remote", remote, "user", session.User, "idle", state.Deadlines.Idle)
+				} else {
+					log.Info("No login in time, disconnecting", "remote", remote, "timeout", state.Deadlines.Auth)
+				}
+				return
+			}
+			log.Info("Connection closed", "remote", remote, "error", err)
+			return
+		}
+		state.Metrics.Packet("in", int(packetID), reader.take())
+		// logging in has a deadline, after that the peer only has to stay alive
+		if loggedIn || registrationID != 0 {
+			setReadTimeout(conn, state.Deadlines.Idle)
+		}
+		switch packetID {
+		case packetPing:
+			ping := *packet.(*MessagePing)
+
+			log.Debug("Got ping", "remote", remote, "token", ping.Token)
+			sendMessage(packetPong, ping) // return as pong
+		case packetPong:
+			pong := *packet.(*MessagePong)
+			log.Debug("Got pong", "remote", remote, "token", pong.Token, "matches", sentPing.Token == pong.Token)
+			if sentPing.Token != pong.Token {
+				break
+			}
+			if sent := atomic.SwapInt64(&pingSent, 0); sent != 0 {
+				state.Metrics.Observe("andromeda_ping_rtt_seconds", metricLabels("side", "host", "network", config.Name), time.Since(time.Unix(0, sent)).Seconds())
+			}
+		case packetAuth:
+			auth := *packet.(*MessageAuth)
+			log.Info("Got user auth attempt", "remote", remote, "user", auth.Username)
+			pending = nil
+
+			// a session stays with the user it logged in as
+			config.Lock()
+			current := session.User
+			config.Unlock()
+			if current != "" {
+				log.Warn("Ignoring auth attempt on a logged in session", "remote", remote, "user", current, "as", auth.Username)
+				continue
+			}
+
+			if wait := config.Logins.LockedOut(ip, auth.Username); wait > 0 {
+				log.Warn("Refusing login during lockout", "remote", remote, "user", auth.Username, "remaining", wait)
+				state.Metrics.Add("andromeda_auth_total", metricLabels("network", config.Name, "outcome", "locked_out"), 1)
+				sendMessage(packetAuthStatus, MessageAuthStatus{RetryAfter: int(wait.Seconds()) + 1})
+				if !countFailure() {
+					return
+				}
+				continue
+			}
+
+			remoteKey := conn.GetServerPublicKey()[:]
+			config.Lock()
+			if session.User == "" {
+				session.SasCommit = auth.SasCommit
+			}
+			config.Unlock()
+			pending = &hostAuthAttempt{Username: auth.Username, Invite: auth.Invite}
+			pending.Challenge.Nonce = randomBytes(scramNonceSize)
+			pending.Challenge.Iterations = scramIterations
+			var authStatus MessageAuthStatus
+			reason := ""
+			keyRegistration := false
+			var invited *Invite
+
+			config.Lock()
+			user := config.findUser(auth.Username)
+			keyMatches := user != nil && bytes.Equal(user.PubKey, remoteKey)
+			keyMismatch := user != nil && user.PubKey != nil && !keyMatches
+			needBoth := user != nil && user.Role >= RoleAdmin && config.AdminsNeedBoth
+			switch {
+			case user != nil && config.AuthMode == AuthModeKey && keyMatches && !needBoth:
+				log.Info("User authenticated by key", "remote", remote, "user", auth.Username)
+				startSession(user, remoteKey, session)
+				authStatus.Success = true
+				pending = nil
+			case needBoth && !keyMatches:
+				reason = "admin key not pinned"
+				pending = nil
+			case needBoth && !user.HasPassword():
+				reason = "admin has no password"
+				pending = nil
+			case user != nil && user.Verifier != nil:
+				pending.Challenge.Salt = user.Verifier.Salt
+				pending.Challenge.Iterations = user.Verifier.Iterations
+			case user != nil && user.HashedPassword != nil:
+				pending.Challenge.Salt = randomBytes(scramSaltSize)
+				pending.Challenge.Bcrypt = bcryptSalt(user.HashedPassword)
+			case user == nil && auth.Invite != "":
+				if err := config.Invites.Check(auth.Invite, auth.Username); err != nil {
+					reason = "invite rejected: " + err.Error()
+					pending = nil
+				} else if config.AuthMode == AuthModeKey {
+					var err error
+					if invited, err = redeemInvite(config, auth.Invite, auth.Username, remoteKey, nil, session); err != nil {
+						reason = err.Error()
+					} else {
+						log.Info("User registered by invite", "remote", remote, "user", auth.Username)
+						authStatus.Success = true
+					}
+					pending = nil
+				} else {
+					pending.Challenge.Salt = randomBytes(scramSaltSize)
+					pending.Challenge.Register = true
+				}
+			case user == nil && config.RegistrationEnabled && config.AuthMode == AuthModeKey:
+				keyRegistration = true
+				pending = nil
+			case user == nil && config.RegistrationEnabled:
+				pending.Challenge.Salt = randomBytes(scramSaltSize)
+				pending.Challenge.Register = true
+			default:
+				pending.Challenge.Salt = fakeScramSalt(auth.Username)
+			}
+			config.Unlock()
+			if invited != nil {
+				audit(state, config, AuditEvent{Kind: AuditInviteRedeemed, Username: auth.Username, Key: auditKey(remoteKey), Remote: session.Remote, Detail: "role " + invited.Role.String()})
+			}
+			if keyMismatch {
+				log.Warn("User presented a different key than pinned", "remote", remote, "user", auth.Username, "pubkey", remoteKey)
+				audit(state, config, AuditEvent{Kind: AuditKeyMismatch, Username: auth.Username, Key: auditKey(remoteKey), Remote: session.Remote})
+			}
+
+			switch {
+			case keyRegistration:
+				requestRegistration(auth.Username, nil)
+			case pending == nil:
+				if !reportAuth(auth.Username, authStatus, reason) {
+					return
+				}
+			default:
+				pending.AuthMessage = scramAuthMessage(auth.Username, auth.Nonce, pending.Challenge.Nonce, remoteKey, conn.GetPublicKey()[:])
+				sendMessage(packetAuthChallenge, pending.Challenge)
+			}
+		case packetAuthProof:
+			proof := *packet.(*MessageAuthProof)
+			if pending == nil {
+				log.Warn("Got auth proof without a challenge", "remote", remote)
+				if !reportAuth("", MessageAuthStatus{}, "unexpected proof") {
+					return
+				}
+				continue
+			}
+			attempt := pending
+			pending = nil
+
+			if attempt.Challenge.Register {
+				if !proof.verifierMatches(attempt) {
+					if !reportAuth(attempt.Username, MessageAuthStatus{}, "invalid registration proof") {
+						return
+					}
+					continue
+				}
+				if attempt.Invite == "" {
+					requestRegistration(attempt.Username, proof.Verifier)
+					continue
+				}
+				var authStatus MessageAuthStatus
+				reason := ""
+				config.Lock()
+				invite, err := redeemInvite(config, attempt.Invite, attempt.Username, conn.GetServerPublicKey()[:], proof.Verifier, session)
+				config.Unlock()
+				if err != nil {
+					reason = err.Error()
+				} else {
+					log.Info("User registered by invite", "remote", remote, "user", attempt.Username)
+					audit(state, config, AuditEvent{Kind: AuditInviteRedeemed, Username: attempt.Username, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: session.Remote, Detail: "role " + invite.Role.String()})
+					authStatus.Success = true
+				}
+				if !reportAuth(attempt.Username, authStatus, reason) {
+					return
+				}
+				continue
+			}
+
+			// the verifier a legacy hash stands for takes as long to make as a
+			// login, so it's made on the work pool and outside the lock
+			var legacy *ScramVerifier
+			if attempt.Challenge.Bcrypt != "" {
+				var hashed []byte
+				config.Lock()
+				if user := config.findUser(attempt.Username); user != nil && user.Verifier == nil {
+					hashed = user.HashedPassword
+				}
+				config.Unlock()
+				if hashed != nil {
+					err := state.Work.Do(func() {
+						_, legacy, _ = ScramClientProof(string(hashed), attempt.Challenge.Salt, attempt.Challenge.Iterations, nil)
+					})
+					if err != nil {
+						log.Warn("Dropping login, work queue is full", "remote", remote, "user", attempt.Username)
+						state.Metrics.Add("andromeda_auth_total", metricLabels("network", config.Name, "outcome", "busy"), 1)
+						sendMessage(packetAuthStatus, MessageAuthStatus{RetryAfter: 1})
+						return
+					}
+				}
+			}
+
+			var authStatus MessageAuthStatus
+			reason := "wrong password"
+			remoteKey := conn.GetServerPublicKey()[:]
+			config.Lock()
+			user := config.findUser(attempt.Username)
+			switch {
+			case user == nil:
+				reason = "unknown user"
+			case user.Role >= RoleAdmin && config.AdminsNeedBoth && !bytes.Equal(user.PubKey, remoteKey):
+				reason = "admin key not pinned"
+			case attempt.Challenge.Bcrypt != "":
+				if legacy != nil && user.Verifier == nil && legacy.VerifyProof(attempt.AuthMessage, proof.Proof) {
+					authStatus.Success = true
+					authStatus.ServerSignature = legacy.ServerSignature(attempt.AuthMessage)
+					if proof.verifierFits(attempt) {
+						log.Info("Upgrading legacy password hash", "user", user.Name)
+						user.Verifier = proof.Verifier
+						user.HashedPassword = nil
+					}
+				}
+			case user.Verifier != nil && user.Verifier.VerifyProof(attempt.AuthMessage, proof.Proof):
+				authStatus.Success = true
+				authStatus.ServerSignature = user.Verifier.ServerSignature(attempt.AuthMessage)
+			}
+			pinned := false
+			if authStatus.Success {
+				pinned = startSession(user, remoteKey, session)
+				reason = ""
+			}
+			config.Unlock()
+			if pinned {
+				audit(state, config, AuditEvent{Kind: AuditKeyPinned, Username: attempt.Username, Key: auditKey(remoteKey), Remote: session.Remote})
+			}
+
+			if !reportAuth(attempt.Username, authStatus, reason) {
+				return
+			}
+		case packetSasReveal:
+			reveal := *packet.(*MessageSasReveal)
+			remoteKey := conn.GetServerPublicKey()[:]
+			config.Lock()
+			revealed := session.User != "" && session.Sas == nil && bytes.Equal(sasCommitment(reveal.Nonce), session.SasCommit)
+			if revealed {
+				session.Sas = ShortAuthString(config.PubKey, remoteKey, session.SasNonce, reveal.Nonce)
+			}
+			config.Unlock()
+			if !revealed {
+				log.Warn("Verification nonce does not match its commitment, disconnecting", "remote", remote, "user", session.User)
+				return
+			}
+		case packetVerify:
+			verify := *packet.(*MessageVerify)
+			sessionUser, _, ok := config.sessionRole(session)
+			if !ok {
+				continue
+			}
+			log.Info("User compared short authentication string", "remote", remote, "user", sessionUser, "match", verify.Match)
+			audit(state, config, AuditEvent{Kind: AuditVerify, Username: sessionUser, Key: auditKey(conn.GetServerPublicKey()[:]), Remote: session.Remote, Detail: fmt.Sprintf("user compared words, match=%t", verify.Match)})
+			if verify.Match {
+				state.GuiBus <- Event{
+					GuiEventShowAlert,
+					GuiReqShowAlert{"Verification", "'" + sessionUser + "' confirmed the verification words match."},
+				}
+			} else {
+				state.GuiBus <- Event{
+					GuiEventShowAlert,
+					GuiReqShowAlert{"Verification failed", "'" + sessionUser + "' reports the verification words differ!\nTheir connection might be intercepted."},
+				}
+			}
+		case packetRegistrationDecision:
+			decision := *packet.(*MessageRegistrationDecision)
+			action := "deny registration"
+			if decision.Allow {
+				action = "allow registration"
+			}
+			adminAction(action, fmt.Sprint(decision.ID), PermissionApproveRegistrations, func(by string) error {
+				return decideRegistration(state, config, log, decision.ID, decision.Allow, by)
+			})
+		case packetKick:
+			kick := *packet.(*MessageKick)
+			adminAction("kick", kick.Username, PermissionKick, func(by string) error {
+				return kickUser(state, config, log, kick.Username, by, kick.Reason)
+			})
+		case packetAdminQuery:
+			adminAction("list members", "", PermissionViewMembers, func(by string) error {
+				return nil
+			})
+		case packetAdminSettings:
+			settings := *packet.(*MessageAdminSettings)
+			adminAction("change settings", fmt.Sprintf("%+v", settings.Settings), PermissionConfigureHost, func(by string) error {
+				if err := config.ApplySettings(settings.Settings); err != nil {
+					return err
+				}
+				state.GuiBus <- Event{
+					GuiEventHostChanged,
+					GuiReqHostChanged{config.ID},
+				}
+				return nil
+			})
+		case packetChat:
+			chat := *packet.(*MessageChat)
+			name, role, ok := config.sessionRole(session)
+			switch {
+			case !ok:
+				sendMessage(packetAdminResult, MessageAdminResult{"chat", "not logged in"})
+			case !role.Can(PermissionChat):
+				sendMessage(packetAdminResult, MessageAdminResult{"chat", "role '" + role.String() + "' may not chat"})
+			case len(chat.Text) > maxChatLength:
+				sendMessage(packetAdminResult, MessageAdminResult{"chat", "message too long"})
+			default:
+				broadcastChat(state, config, MessageChat{name, chat.Text})
+			}
+		case packetAdminSetRole:
+			setRole := *packet.(*MessageAdminSetRole)
+			adminAction("set role "+setRole.Role.String(), setRole.Username, PermissionManageRoles, func(by string) error {
+				return config.SetRole(setRole.Username, setRole.Role, by)
+			})
+		default:
+			log.Warn("Unexpected packet incoming", "remote", remote, "type", packetID)
+		}
+	}
+}
+
+func handleClientConnection(state Andromeda, log *Logger, client *ClientConfig) {
+	conn := client.Conn
+	var sentPing MessagePing // hold on to last ping we sent for pong
+	queue := NewSendQueue(conn, state.Queues, log, state.Metrics)
+	defer queue.Close()
+	sendMessage := queue.Send
+	reader := &meteredReader{r: conn}
+	decoder := msgpack.NewDecoder(reader)
+	var keepaliveSent int64 // UnixNano of the keepalive waiting for its pong, atomic
+
+	client.Lock()
+	client.Queue = queue
+	client.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	if interval := state.Deadlines.Keepalive; interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				atomic.CompareAndSwapInt64(&keepaliveSent, 0, time.Now().UnixNano())
+				if queue.Send(packetPing, MessagePing{"keepalive"}) == ErrSendQueueClosed {
+					return
+				}
+			}
+		}()
+	}
+
+	sasNonce := randomBytes(sasNonceSize) // revealed to the host once it sent its own
+	sasRevealed := false
+	var auth MessageAuth
+	auth.Username = client.Username
+	auth.Nonce = randomBytes(scramNonceSize)
+	auth.Invite = client.Invite
+	auth.SasCommit = sasCommitment(sasNonce)
+	sendMessage(packetAuth, auth)
+
+	var authMessage []byte
+	var verifier *ScramVerifier
+	expectSignature := false
+	settled := false // logged in or waiting for approval, only idleness counts
+
+	setReadTimeout(conn, state.Deadlines.Auth)
+	for {
+		packetID, packet, err := readPacket(reader, decoder)
+		if err != nil {
+			var packetErr *PacketError
+			var netErr net.Error
+			if errors.As(err, &packetErr) {
+				log.Warn("Malformed packet, disconnecting", "type", packetErr.ID, "error", packetErr.Err)
+				return
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				message := "The host did not answer the login in time"
+				if settled {
+					log.Warn("Host stopped responding, disconnecting", "address", client.Server, "idle", state.Deadlines.Idle)
+					message = "Lost connection to " + client.Server + ":\nthe host stopped responding"
+				} else {
+					log.Warn("Login timed out", "address", client.Server, "timeout", state.Deadlines.Auth)
+				}
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", message},
+				}
+				return
+			}
+			log.Info("Connection closed", "error", err)
+			return
+		}
+		state.Metrics.Packet("in", int(packetID), reader.take())
+		if settled {
+			setReadTimeout(conn, state.Deadlines.Idle)
+		}
+		switch packetID {
+		case packetPing:
+			ping := *packet.(*MessagePing)
+
+			log.Debug("Got ping", "token", ping.Token)
+			sendMessage(packetPong, ping) // return as pong
+		case packetPong:
+			pong := *packet.(*MessagePong)
+			log.Debug("Got pong", "token", pong.Token, "matches", sentPing.Token == pong.Token)
+			if sent := atomic.SwapInt64(&keepaliveSent, 0); pong.Token == "keepalive" && sent != 0 {
+				state.Metrics.Observe("andromeda_ping_rtt_seconds", metricLabels("side", "client", "network", client.Server), time.Since(time.Unix(0, sent)).Seconds())
+			}
+		case packetAuthChallenge:
+			challenge := *packet.(*MessageAuthChallenge)
+			if client.Password == "" {
+				log.Error("Host requires a password for this account")
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", "The host requires a password for this account"},
+				}
+				queue.Close()
+				return
+			}
+
+			authMessage = scramAuthMessage(auth.Username, auth.Nonce, challenge.Nonce, conn.GetPublicKey()[:], conn.GetServerPublicKey()[:])
+			if challenge.Bcrypt != "" {
+				log.Info("Host still has a legacy password hash, sending a verifier to replace it")
+			}
+			var proof MessageAuthProof
+			proof, verifier, err = answerChallenge(client.Password, challenge, authMessage)
+			if err != nil {
+				log.Error("Can't answer auth challenge", "error", err)
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", "Authentication failure"},
+				}
+				queue.Close()
+				return
+			}
+			expectSignature = !challenge.Register
+			sendMessage(packetAuthProof, proof)
+		case packetAuthPending:
+			pending := *packet.(*MessageAuthPending)
+			log.Info("Registration requested, waiting for host approval", "expires", pending.Expires)
+			settled = true
+			setReadTimeout(conn, state.Deadlines.Idle)
+			state.GuiBus <- Event{
+				GuiEventShowMessage,
+				GuiReqShowMessage{"Join", fmt.Sprintf("Registration requested\nWaiting for the host to approve (up to %d minutes)", pending.Expires/60)},
+			}
+		case packetAuthStatus:
+			authStatus := *packet.(*MessageAuthStatus)
+			if authStatus.Success && expectSignature && !verifier.VerifyServerSignature(authMessage, authStatus.ServerSignature) {
+				log.Error("Host accepted login but could not prove it knows our credentials")
+				authStatus.Success = false
+			}
+			if authStatus.Success {
+				log.Info("Auth success", "role", authStatus.Role)
+				settled = true
+				setReadTimeout(conn, state.Deadlines.Idle)
+				client.Lock()
+				client.Role = authStatus.Role
+				client.Unlock()
+				if !sasRevealed {
+					sasRevealed = true
+					sendMessage(packetSasReveal, MessageSasReveal{sasNonce})
+				}
+				if known, _ := state.KnownHost(client.Server); known.Verified && bytes.Equal(known.HostKey, conn.GetServerPublicKey()[:]) {
+					state.GuiBus <- Event{
+						GuiEventShowSession,
+						GuiReqShowSession{client.ID, "Host key verified"},
+					}
+				} else {
+					state.GuiBus <- Event{
+						GuiEventShowVerify,
+						GuiReqShowVerify{
+							0,
+							client.ID,
+							"",
+							ShortAuthString(conn.GetServerPublicKey()[:], conn.GetPublicKey()[:], authStatus.SasNonce, sasNonce),
+						},
+					}
+				}
+			} else if authStatus.RetryAfter > 0 {
+				log.Warn("Auth fail, locked out", "retry_after", authStatus.RetryAfter)
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", fmt.Sprintf("Authentication failure\nToo many attempts, retry in %d seconds", authStatus.RetryAfter)},
+				}
+			} else {
+				log.Warn("Auth fail")
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", "Authentication failure"},
+				}
+			}
+		case packetVerify:
+			verify := *packet.(*MessageVerify)
+			log.Info("Host compared short authentication string", "match", verify.Match)
+			if !verify.Match {
+				log.Error("Host reports verification words differ, disconnecting")
+				queue.Close()
+				state.GuiBus <- Event{
+					GuiEventShowMessage,
+					GuiReqShowMessage{"Join", "The host reports the verification words differ!\nYour connection might be intercepted."},
+				}
+				return
+			}
+		case packetRegistrationRequest:
+			registration := *packet.(*MessageRegistrationRequest)
+			log.Info("Host forwarded registration request", "user", registration.Username, "id", registration.ID)
+			client.Lock()
+			client.Registrations = append(client.Registrations, registration)
+			client.Unlock()
+			state.GuiBus <- Event{
+				GuiEventSessionChanged,
+				GuiReqSessionChanged{client.ID},
+			}
+		case packetRegistrationDecision:
+			decision := *packet.(*MessageRegistrationDecision)
+			client.Lock()
+			for i, registration := range client.Registrations {
+				if registration.ID == decision.ID {
+					client.Registrations = append(client.Registrations[:i], client.Registrations[i+1:]...)
+					break
+				}
+			}
+			client.Unlock()
+			state.GuiBus <- Event{
+				GuiEventSessionChanged,
+				GuiReqSessionChanged{client.ID},
+			}
+		case packetKick:
+			kick := *packet.(*MessageKick)
+			log.Warn("Kicked from the network", "by", kick.Username, "reason", kick.Reason)
+			queue.Close()
+			message := "You were kicked from the network"
+			if kick.Username != "" {
+				message += " by '" + kick.Username + "'"
+			}
+			if kick.Reason != "" {
+				message += ":\n" + kick.Reason
+			}
+			state.GuiBus <- Event{
+				GuiEventShowMessage,
+				GuiReqShowMessage{"Join", message},
+			}
+			return
+		case packetAdminState:
+			adminState := *packet.(*MessageAdminState)
+			client.Lock()
+			client.AdminState = &adminState
+			client.Unlock()
+			state.GuiBus <- Event{
+				GuiEventSessionChanged,
+				GuiReqSessionChanged{client.ID},
+			}
+		case packetChat:
+			chat := *packet.(*MessageChat)
+			state.GuiBus <- Event{
+				GuiEventChat,
+				GuiReqChat{0, client.ID, chat.From, chat.Text},
+			}
+		case packetAdminResult:
+			result := *packet.(*MessageAdminResult)
+			if result.Error != "" {
+				log.Warn("Host refused admin action", "action", result.Action, "error", result.Error)
+				state.GuiBus <- Event{
+					GuiEventShowAlert,
+					GuiReqShowAlert{"Refused", "The host refused the " + result.Action + ":\n" + result.Error},
+				}
+			}
+		default:
+			log.Warn("Unexpected packet incoming", "type", packetID)
+		}
+	}
+}
+
+// startSession attaches a logged in user to this connection, pinning the key
+// it came from on first use; HostConfig must be locked
+func startSession(user *User, pubKey []byte, session *Session) (pinned bool) {
+	if user.PubKey == nil {
+		user.PubKey = pubKey
+		pinned = true
+	}
+	session.User = user.Name
+	user.Session = session
+	return
+}
+
+// sessionRole returns who is logged in on session and their current role
+func (config *HostConfig) sessionRole(session *Session) (string, Role, bool) {
+	config.Lock()
+	defer config.Unlock()
+	if user := config.findUser(session.User); user != nil && user.Session == session {
+		return user.Name, user.Role, true
+	}
+	return "", RoleGuest, false
+}
+
+// notifyPermitted sends a packet to every online user whose role holds permission
+func notifyPermitted(config *HostConfig, permission Permission, packetID int, message interface{}) {
+	var sessions []*Session
+	config.Lock()
+	for _, user := range config.Users {
+		if user.Session != nil && user.Role.Can(permission) {
+			sessions = append(sessions, user.Session)
+		}
+	}
+	config.Unlock()
+	for _, session := range sessions {
+		session.Send(packetID, message)
+	}
+}
+
+// broadcastChat passes a chat message to everyone on the network allowed to
+// chat, and shows it to the host
+func broadcastChat(state Andromeda, config *HostConfig, chat MessageChat) {
+	notifyPermitted(config, PermissionChat, packetChat, chat)
+	state.GuiBus <- Event{
+		GuiEventChat,
+		GuiReqChat{config.ID, 0, chat.From, chat.Text},
+	}
+}
+
+// decideRegistration settles a pending registration request; by is the
+// admin deciding remotely, empty for the host itself
+func decideRegistration(state Andromeda, config *HostConfig, log *Logger, id int, allow bool, by string) error {
+	registration := config.Registrations.Take(id)
+	if registration == nil {
+		return errors.New("registration request already handled or expired")
+	}
+	var authStatus MessageAuthStatus
+	event := AuditEvent{
+		Kind:     AuditRegistrationDenied,
+		Username: registration.Username,
+		Actor:    by,
+		Key:      auditKey(registration.PubKey),
+		Remote:   registration.Session.Remote,
+	}
+	if allow {
+		config.Lock()
+		if registerUser(config, registration.Username, registration.PubKey, registration.Verifier, RoleMember, registration.Session) != nil {
+			log.Info("Added user to user list", "user", registration.Username, "by", by)
+			authStatus.Success = true
+			authStatus.Role = RoleMember
+			authStatus.SasNonce = registration.Session.SasNonce
+			event.Kind = AuditRegistrationAllowed
+		} else {
+			log.Warn("Username was taken while registration was pending", "user", registration.Username)
+			event.Detail = "username taken"
+		}
+		config.Unlock()
+	} else {
+		log.Info("Registration denied", "user", registration.Username, "remote", registration.Session.Remote, "by", by)
+	}
+	audit(state, config, event)
+	outcome := "denied"
+	if authStatus.Success {
+		outcome = "allowed"
+		registration.Session.LoggedIn(registration.Username)
+	}
+	state.Metrics.Add("andromeda_registrations_total", metricLabels("network", config.Name, "outcome", outcome), 1)
+	registration.Session.Send(packetAuthStatus, authStatus)
+	notifyPermitted(config, PermissionApproveRegistrations, packetRegistrationDecision, MessageRegistrationDecision{id, authStatus.Success})
+	state.GuiBus <- Event{
+		GuiEventHostChanged,
+		GuiReqHostChanged{config.ID},
+	}
+	return nil
+}
+
+func adminState(config *HostConfig) MessageAdminState {
+	return MessageAdminState{
+		Members:  config.Members(),
+		Settings: config.Settings(),
+	}
+}
+
+// audit appends to the host's audit log, complaining loudly if it can't
+func audit(state Andromeda, config *HostConfig, event AuditEvent) {
+	if err := config.Audit.Append(event); err != nil {
+		state.Log.With("audit").Error("Can't write audit log", "network", config.Name, "kind", event.Kind, "error", err)
+	}
+}
+
+// recordAdmin logs an admin action and adds it to the audit log; an empty
+// Username is the host itself
+func recordAdmin(state Andromeda, config *HostConfig, action AdminAction) {
+	log := state.Log.With("admin")
+	detail := action.Action
+	if action.Error != "" {
+		detail += " refused: " + action.Error
+	}
+	audit(state, config, AuditEvent{Kind: AuditAdmin, Username: action.Target, Actor: action.Username, Remote: action.Remote, Detail: detail})
+	if action.Error != "" {
+		log.Warn("Admin action refused", "user", action.Username, "remote", action.Remote, "action", action.Action, "target", action.Target, "error", action.Error)
+	} else {
+		log.Info("Admin action", "user", action.Username, "remote", action.Remote, "action", action.Action, "target", action.Target)
+	}
+}
+
+// kickUser drops username's session; by is the admin kicking remotely,
+// empty for the host itself
+func kickUser(state Andromeda, config *HostConfig, log *Logger, username, by, reason string) error {
+	config.Lock()
+	target := config.findUser(username)
+	if target == nil || target.Session == nil {
+		config.Unlock()
+		return errors.New("'" + username + "' is not connected")
+	}
+	if by != "" {
+		actor := config.findUser(by)
+		if actor == nil || !actor.Role.Can(PermissionKick) || !actor.Role.Outranks(target.Role) {
+			config.Unlock()
+			return errors.New("not allowed to kick '" + username + "'")
+		}
+	}
+	session := target.Session
+	target.Session = nil
+	config.Unlock()
+
+	log.Warn("Kicked user", "user", username, "remote", session.Remote, "by", by, "reason", reason)
+	audit(state, config, AuditEvent{Kind: AuditKick, Username: username, Actor: by, Remote: session.Remote, Detail: reason})
+	session.Send(packetKick, MessageKick{by, reason})
+	session.Close()
+	if by != "" {
+		state.GuiBus <- Event{
+			GuiEventShowAlert,
+			GuiReqShowAlert{"Kick", "'" + by + "' kicked '" + username + "'."},
+		}
+	}
+	return nil
+}
+
+// registerUser adds a new user and starts its session, nil if the name is
+// already taken; HostConfig must be locked
+func registerUser(config *HostConfig, name string, pubKey []byte, verifier *ScramVerifier, role Role, session *Session) *User {
+	if config.findUser(name) != nil {
+		return nil
+	}
+	user := &User{
+		Name:     name,
+		Role:     role,
+		Verifier: verifier,
+	}
+	startSession(user, pubKey, session)
+	config.Users = append(config.Users, user)
+	return user
+}
+
+var errUsernameTaken = errors.New("username taken")
+
+// redeemInvite registers name with the role of invite code; the invite is
+// only used up if that worked. config must be locked
+func redeemInvite(config *HostConfig, code, name string, pubKey []byte, verifier *ScramVerifier, session *Session) (*Invite, error) {
+	invite, err := config.Invites.Redeem(code, name, func(invite *Invite) error {
+		if registerUser(config, name, pubKey, verifier, invite.Role, session) == nil {
+			return errUsernameTaken
+		}
+		return nil
+	})
+	if err != nil && err != errUsernameTaken {
+		err = errors.New("invite rejected: " + err.Error())
+	}
+	return invite, err
+}
+
+// verifierFits checks a proof's verifier was derived for this challenge
+func (proof MessageAuthProof) verifierFits(attempt *hostAuthAttempt) bool {
+	return proof.Verifier != nil &&
+		string(proof.Verifier.Salt) == string(attempt.Challenge.Salt) &&
+		proof.Verifier.Iterations == attempt.Challenge.Iterations &&
+		len(proof.Verifier.StoredKey) == sha256.Size &&
+		len(proof.Verifier.ServerKey) == sha256.Size
+}
+
+// verifierMatches checks a proof's verifier was derived for this challenge
+// and that the proof itself is valid against it
+func (proof MessageAuthProof) verifierMatches(attempt *hostAuthAttempt) bool {
+	return proof.verifierFits(attempt) && proof.Verifier.VerifyProof(attempt.AuthMessage, proof.Proof)
+}
+
+// boundSendMessage writes each packet to conn in a single Write, so it goes
+// out as one frame
+func boundSendMessage(conn io.Writer) func(packetID int, message interface{}) (err error) {
 	return func(packetID int, message interface{}) (err error) {
-		conn.Write([]byte{byte(packetID)})
-		err = encoder.Encode(&message)
+		var packet bytes.Buffer
+		packet.WriteByte(byte(packetID))
+		if err = msgpack.NewEncoder(&packet).Encode(&message); err != nil {
+			return
+		}
+		_, err = conn.Write(packet.Bytes())
 		return
 	}
 }
+
+// PacketError is a packet that could not be parsed; the stream can't be
+// resynchronized after one, so the connection has to be dropped
+type PacketError struct {
+	ID  uint8
+	Err error
+}
+
+func (err *PacketError) Error() string {
+	return fmt.Sprintf("packet type %d: %v", err.ID, err.Err)
+}
+
+func (err *PacketError) Unwrap() error {
+	return err.Err
+}
+
+// newPacket returns a pointer to an empty message of packetID, nil if the
+// type is unknown
+func newPacket(packetID uint8) interface{} {
+	switch packetID {
+	case packetPing:
+		return &MessagePing{}
+	case packetPong:
+		return &MessagePong{}
+	case packetAuth:
+		return &MessageAuth{}
+	case packetAuthStatus:
+		return &MessageAuthStatus{}
+	case packetAuthChallenge:
+		return &MessageAuthChallenge{}
+	case packetAuthProof:
+		return &MessageAuthProof{}
+	case packetAuthPending:
+		return &MessageAuthPending{}
+	case packetVerify:
+		return &MessageVerify{}
+	case packetRegistrationRequest:
+		return &MessageRegistrationRequest{}
+	case packetRegistrationDecision:
+		return &MessageRegistrationDecision{}
+	case packetKick:
+		return &MessageKick{}
+	case packetAdminResult:
+		return &MessageAdminResult{}
+	case packetAdminQuery:
+		return &MessageAdminQuery{}
+	case packetAdminState:
+		return &MessageAdminState{}
+	case packetAdminSettings:
+		return &MessageAdminSettings{}
+	case packetAdminSetRole:
+		return &MessageAdminSetRole{}
+	case packetChat:
+		return &MessageChat{}
+	case packetSasReveal:
+		return &MessageSasReveal{}
+	}
+	return nil
+}
+
+// readPacket reads one packet, a type byte followed by its msgpack payload;
+// decoder has to read from r. Errors reading the type byte come back as is,
+// anything after it as a *PacketError
+func readPacket(r io.ByteReader, decoder *msgpack.Decoder) (uint8, interface{}, error) {
+	packetID, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	packet := newPacket(packetID)
+	if packet == nil {
+		return packetID, nil, &PacketError{packetID, errors.New("unknown packet type")}
+	}
+	if err := decoder.Decode(packet); err != nil {
+		return packetID, nil, &PacketError{packetID, err}
+	}
+	return packetID, packet, nil
+}
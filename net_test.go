@@ -0,0 +1,623 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coderobe/securenet"
+	"github.com/vmihailenco/msgpack/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordLogin(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleAdmin)
+	network.join("alice", "correct horse")
+
+	client := network.waitLoggedIn("alice")
+	client.Lock()
+	role := client.Role
+	client.Unlock()
+	if role != RoleAdmin {
+		t.Errorf("client was told role %s, want admin", role)
+	}
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+	if !network.audited(AuditLogin, "alice") {
+		t.Error("login was not audited")
+	}
+}
+
+func TestShortAuthStringAgrees(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+
+	event := network.waitEvent("verification words", func(event Event) bool {
+		_, ok := event.Event.(GuiReqShowVerify)
+		return ok
+	})
+	words := strings.Join(event.Event.(GuiReqShowVerify).Words, " ")
+	var hostWords string
+	network.waitUntil("host to get alice's verification nonce", func() bool {
+		network.host.Lock()
+		defer network.host.Unlock()
+		if user := network.host.findUser("alice"); user != nil && user.Session != nil {
+			hostWords = strings.Join(user.Session.Sas, " ")
+		}
+		return hostWords != ""
+	})
+	if hostWords != words {
+		t.Errorf("host shows %q, client shows %q", hostWords, words)
+	}
+
+	// the same keys give different words in the next session
+	network.join("alice", "correct horse")
+	event = network.waitEvent("verification words", func(event Event) bool {
+		_, ok := event.Event.(GuiReqShowVerify)
+		return ok
+	})
+	if strings.Join(event.Event.(GuiReqShowVerify).Words, " ") == words {
+		t.Error("two sessions with the same keys got the same words")
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "battery staple")
+
+	network.waitMessage("Authentication failure")
+	if network.session("alice") != nil {
+		t.Error("wrong password started a session")
+	}
+	network.waitUntil("failed login in audit log", func() bool {
+		return network.audited(AuditLoginFailed, "alice")
+	})
+}
+
+// a user with a bcrypt hash from before SCRAM logs in without the password
+// leaving the client, and has the hash replaced by a verifier
+func TestLegacyHashUpgraded(t *testing.T) {
+	network := newTestNetwork(t)
+	hashed, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.host.Lock()
+	network.host.Users = append(network.host.Users, &User{Name: "alice", Role: RoleMember, HashedPassword: hashed})
+	network.host.Unlock()
+
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.host.Lock()
+	user := network.host.findUser("alice")
+	upgraded := user.Verifier != nil && user.HashedPassword == nil
+	network.host.Unlock()
+	if !upgraded {
+		t.Fatal("legacy hash was not replaced by a verifier")
+	}
+
+	network.state.NetBus <- Event{NetEventLeave, NetReqLeave{client.ID}}
+	network.waitUntil("alice to disconnect", func() bool {
+		return network.client("alice") == nil && network.session("alice") == nil
+	})
+	network.join("alice", "correct horse")
+	network.waitLoggedIn("alice")
+}
+
+// with admins needing both, an admin that registered with only a key can't
+// answer a password challenge and must be told so
+func TestAdminWithoutPasswordRefused(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse") // pins alice's key
+	client := network.waitLoggedIn("alice")
+	network.state.NetBus <- Event{NetEventLeave, NetReqLeave{client.ID}}
+	network.waitUntil("alice to disconnect", func() bool {
+		return network.client("alice") == nil && network.session("alice") == nil
+	})
+
+	network.host.Lock()
+	network.host.findUser("alice").Verifier = nil
+	network.host.AdminsNeedBoth = true
+	network.host.Unlock()
+	if err := network.host.SetRole("alice", RoleAdmin, ""); err == nil {
+		t.Error("promoted a key-only user while admins need both")
+	}
+	network.host.Lock()
+	network.host.findUser("alice").Role = RoleAdmin // promoted before the setting was on
+	network.host.Unlock()
+
+	network.join("alice", "correct horse")
+	network.waitMessage("Authentication failure")
+	network.waitUntil("refusal in audit log", func() bool {
+		for _, event := range network.host.Audit.Events(AuditFilter{Kind: AuditLoginFailed}, 0) {
+			if event.Detail == "admin has no password" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestLockoutAuditedOnce(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	// the free failures, the one causing a lockout, then attempts during it
+	for i := 0; i < DefaultLoginLimitConfig.FreeFailures+4; i++ {
+		network.join("alice", "battery staple")
+		network.waitMessage("Authentication failure")
+	}
+
+	failed := len(network.host.Audit.Events(AuditFilter{Kind: AuditLoginFailed}, 0))
+	lockouts := len(network.host.Audit.Events(AuditFilter{Kind: AuditLockout}, 0))
+	if failed != DefaultLoginLimitConfig.FreeFailures || lockouts != 1 {
+		t.Errorf("audited %d failed logins and %d lockouts, want %d and 1", failed, lockouts, DefaultLoginLimitConfig.FreeFailures)
+	}
+}
+
+func TestSettingsChangedDuringFailedLogin(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		// a remote admin changing settings, for the race detector
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			network.host.ApplySettings(network.host.Settings())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	network.join("alice", "battery staple")
+	network.waitMessage("Authentication failure")
+	close(done)
+	<-stopped
+}
+
+func TestUnknownUserWithoutRegistration(t *testing.T) {
+	network := newTestNetwork(t)
+	network.join("mallory", "anything")
+
+	network.waitMessage("Authentication failure")
+	network.host.Lock()
+	users := len(network.host.Users)
+	network.host.Unlock()
+	if users != 0 {
+		t.Errorf("host has %d users, want none", users)
+	}
+}
+
+func TestInviteKeptWhenRegistrationFails(t *testing.T) {
+	network := newTestNetwork(t)
+	invite := network.host.Invites.Create("bob", RoleMember, true, time.Hour)
+	// bob registered some other way between the challenge and the proof
+	network.addUser("bob", "correct horse", RoleMember)
+
+	network.host.Lock()
+	_, err := redeemInvite(network.host, invite.Code, "bob", nil, nil, &Session{})
+	network.host.Unlock()
+	if err != errUsernameTaken {
+		t.Errorf("registering a taken username returned %v", err)
+	}
+	if err := network.host.Invites.Check(invite.Code, "bob"); err != nil {
+		t.Errorf("failed registration used up the invite: %v", err)
+	}
+}
+
+func TestRegistrationApproved(t *testing.T) {
+	network := newTestNetwork(t)
+	network.host.RegistrationEnabled = true
+	network.AutoApprove = true
+	network.join("bob", "hunter2")
+
+	network.waitLoggedIn("bob")
+	network.host.Lock()
+	user := network.host.findUser("bob")
+	network.host.Unlock()
+	if user == nil || user.Role != RoleMember || user.Verifier == nil {
+		t.Fatalf("bob was not registered as a member with a password: %+v", user)
+	}
+	if !network.audited(AuditRegistrationAllowed, "bob") {
+		t.Error("approval was not audited")
+	}
+
+	// the stored verifier has to work for the next login too
+	network.state.NetBus <- Event{NetEventLeave, NetReqLeave{network.client("bob").ID}}
+	network.waitUntil("bob to disconnect", func() bool {
+		return network.client("bob") == nil && network.session("bob") == nil
+	})
+	network.join("bob", "hunter2")
+	network.waitLoggedIn("bob")
+}
+
+// an approved registration logs the connection in just like a password would
+func TestRegistrationApprovedLogsIn(t *testing.T) {
+	network := newTestNetwork(t)
+	network.host.RegistrationEnabled = true
+	network.AutoApprove = true
+	network.join("bob", "hunter2")
+	network.waitLoggedIn("bob")
+
+	if pending := network.state.Pending.Pending("127.0.0.1"); pending != 0 {
+		t.Errorf("approved member still holds %d pending slots", pending)
+	}
+	if !network.audited(AuditLogin, "bob") {
+		t.Error("login by approval was not audited")
+	}
+}
+
+func TestRegistrationDenied(t *testing.T) {
+	network := newTestNetwork(t)
+	network.host.RegistrationEnabled = true
+	network.join("carol", "hunter2")
+
+	network.waitMessage("Waiting for the host to approve")
+	registrations := network.host.Registrations.List()
+	if len(registrations) != 1 || registrations[0].Username != "carol" {
+		t.Fatalf("expected carol's pending registration, got %v", registrations)
+	}
+	network.state.NetBus <- Event{
+		NetEventRegistration,
+		NetReqRegistration{network.host.ID, registrations[0].ID, false},
+	}
+
+	network.waitMessage("Authentication failure")
+	network.host.Lock()
+	user := network.host.findUser("carol")
+	network.host.Unlock()
+	if user != nil {
+		t.Error("denied registration created a user")
+	}
+	if !network.audited(AuditRegistrationDenied, "carol") {
+		t.Error("denial was not audited")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	network.state.NetBus <- Event{NetEventLeave, NetReqLeave{client.ID}}
+	network.waitUntil("host to drop alice's session", func() bool {
+		return network.session("alice") == nil
+	})
+	network.waitUntil("client to be removed", func() bool {
+		return network.state.Clients.Get(client.ID) == nil
+	})
+}
+
+func TestKick(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	network.state.NetBus <- Event{NetEventKick, NetReqKick{network.host.ID, "alice", "testing"}}
+	network.waitUntil("client to be removed", func() bool {
+		return network.state.Clients.Get(client.ID) == nil
+	})
+	if network.session("alice") != nil {
+		t.Error("kicked user still has a session")
+	}
+	if !network.audited(AuditKick, "alice") {
+		t.Error("kick was not audited")
+	}
+}
+
+func TestSecondAuthIgnored(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", loadTestPassword, RoleMember)
+	network.addUser("bob", loadTestPassword, RoleMember)
+	conn, _, _, err := loadTestLogin(network.state.Link, network.address(), "alice", harnessTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a challenge would let alice's session become bob's
+	boundSendMessage(conn)(packetAuth, MessageAuth{Username: "bob", Nonce: randomBytes(scramNonceSize)})
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	decoder := msgpack.NewDecoder(conn)
+	for {
+		packetID, _, err := readPacket(conn, decoder)
+		if err != nil {
+			break
+		}
+		if packetID == packetAuthChallenge || packetID == packetAuthStatus {
+			t.Fatalf("host answered a second auth with packet %d", packetID)
+		}
+	}
+	if network.session("alice") == nil {
+		t.Error("second auth dropped the session")
+	}
+}
+
+func TestKickReason(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	// the kick is queued before the hang up, so it has to arrive
+	network.state.NetBus <- Event{NetEventKick, NetReqKick{network.host.ID, "alice", "testing"}}
+	network.waitMessage("testing")
+}
+
+func TestConcurrentSends(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleAdmin)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	session := network.session("alice")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if j%2 == 0 {
+					session.Send(packetPing, MessagePing{fmt.Sprintf("%d-%d", i, j)})
+				} else {
+					session.Send(packetAdminState, adminState(network.host))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	// the client would drop a connection with interleaved packets
+	network.state.Clients.Send(client.ID, packetAdminQuery, MessageAdminQuery{})
+	network.waitEvent("admin state after the burst", func(event Event) bool {
+		changed, ok := event.Event.(GuiReqSessionChanged)
+		return ok && changed.Client == client.ID
+	})
+	if network.state.Clients.Get(client.ID) == nil || network.session("alice") != session {
+		t.Error("concurrent sends broke the session")
+	}
+}
+
+func TestChat(t *testing.T) {
+	network := newTestNetwork(t)
+	network.addUser("alice", "correct horse", RoleMember)
+	network.addUser("bob", "battery staple", RoleGuest)
+	network.join("alice", "correct horse")
+	alice := network.waitLoggedIn("alice")
+	network.join("bob", "battery staple")
+	bob := network.waitLoggedIn("bob")
+	network.waitUntil("both sessions", func() bool {
+		return network.session("alice") != nil && network.session("bob") != nil
+	})
+
+	network.state.NetBus <- Event{NetEventChat, NetReqChat{Client: alice.ID, Text: "hello"}}
+	seen := map[int]bool{}
+	for len(seen) < 3 {
+		event := network.waitEvent("chat from alice everywhere", func(event Event) bool {
+			chat, ok := event.Event.(GuiReqChat)
+			return ok && chat.From == "alice" && chat.Text == "hello"
+		})
+		chat := event.Event.(GuiReqChat)
+		seen[chat.Client] = true // 0 is the host
+	}
+	if !seen[0] || !seen[alice.ID] || !seen[bob.ID] {
+		t.Errorf("chat reached %v", seen)
+	}
+
+	network.state.NetBus <- Event{NetEventChat, NetReqChat{Host: network.host.ID, Text: "from the host"}}
+	network.waitEvent("host chat at bob", func(event Event) bool {
+		chat, ok := event.Event.(GuiReqChat)
+		return ok && chat.Client == bob.ID && chat.From == "" && chat.Text == "from the host"
+	})
+}
+
+func TestConcurrentClients(t *testing.T) {
+	network := newTestNetwork(t)
+	const clients = 5
+	for i := 0; i < clients; i++ {
+		network.addUser(fmt.Sprintf("user%d", i), "password", RoleMember)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			network.join(fmt.Sprintf("user%d", i), "password")
+		}(i)
+	}
+	wg.Wait()
+
+	network.waitUntil("every user to be online", func() bool {
+		for _, member := range network.host.Members() {
+			if !member.Online {
+				return false
+			}
+		}
+		return true
+	})
+	if online := len(network.state.Clients.List()); online != clients {
+		t.Errorf("%d clients connected, want %d", online, clients)
+	}
+}
+
+func TestLoginOverBadLink(t *testing.T) {
+	network := newTestNetworkOver(t, NewLink(LinkConditions{
+		Latency:    20 * time.Millisecond,
+		Jitter:     10 * time.Millisecond,
+		Loss:       0.2,
+		Retransmit: 20 * time.Millisecond,
+		Bandwidth:  16384,
+		ReadChunk:  5,
+		Seed:       1,
+	}))
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+
+	network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+}
+
+func TestSlowReader(t *testing.T) {
+	network := newTestNetworkOver(t, NewLink(LinkConditions{ReadDelay: 5 * time.Millisecond, ReadChunk: 1}))
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+
+	network.waitLoggedIn("alice")
+}
+
+func TestLinkResetDropsSession(t *testing.T) {
+	network := newTestNetworkOver(t, NewLink(LinkConditions{Latency: 5 * time.Millisecond}))
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	network.state.Link.Reset()
+	network.waitUntil("host to drop alice's session", func() bool {
+		return network.session("alice") == nil
+	})
+	network.waitUntil("client to be removed", func() bool {
+		return network.state.Clients.Get(client.ID) == nil
+	})
+}
+
+func TestPendingPerIP(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Pending = NewPendingLimiter(1)
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+
+	// a stranger sitting on the handshake takes the only slot
+	stranger, err := net.Dial("tcp", network.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.waitUntil("the stranger to count as pending", func() bool {
+		return network.state.Pending.Pending("127.0.0.1") == 1
+	})
+	network.join("alice", "correct horse")
+	network.waitMessage("Can't connect")
+
+	stranger.Close()
+	network.waitUntil("the stranger's slot to be released", func() bool {
+		return network.state.Pending.Pending("127.0.0.1") == 0
+	})
+	network.join("alice", "correct horse")
+	network.waitLoggedIn("alice")
+	network.waitUntil("logged in connections to stop counting", func() bool {
+		return network.state.Pending.Pending("127.0.0.1") == 0
+	})
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Deadlines.Handshake = 100 * time.Millisecond
+	})
+
+	stranger, err := net.Dial("tcp", network.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stranger.SetReadDeadline(time.Now().Add(harnessTimeout))
+	// the host sends its half of the key exchange, then has to give up on us
+	if _, err := io.Copy(ioutil.Discard, stranger); err != nil {
+		t.Fatalf("host did not hang up on a stalled handshake: %v", err)
+	}
+	network.waitUntil("the stalled connection's slot to be released", func() bool {
+		return network.state.Pending.Pending("127.0.0.1") == 0
+	})
+}
+
+func TestIdleSessionReaped(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Deadlines.Idle = 200 * time.Millisecond
+		state.Deadlines.Keepalive = 0
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+
+	network.waitUntil("host to reap alice's idle session", func() bool {
+		return network.session("alice") == nil
+	})
+	network.waitUntil("client to be removed", func() bool {
+		return network.state.Clients.Get(client.ID) == nil
+	})
+}
+
+func TestKeepaliveKeepsSession(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Deadlines.Idle = 300 * time.Millisecond
+		state.Deadlines.Keepalive = 50 * time.Millisecond
+	})
+	network.addUser("alice", "correct horse", RoleMember)
+	network.join("alice", "correct horse")
+	client := network.waitLoggedIn("alice")
+	network.waitUntil("host session for alice", func() bool {
+		return network.session("alice") != nil
+	})
+
+	time.Sleep(time.Second)
+	if network.session("alice") == nil || network.state.Clients.Get(client.ID) == nil {
+		t.Error("session was dropped despite keepalives")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	network := newTestNetworkWith(t, func(state *Andromeda) {
+		state.Deadlines.Auth = 100 * time.Millisecond
+	})
+
+	pConn, err := net.Dial("tcp", network.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn.Close()
+	pub, priv, elligator, err := securenet.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := securenet.WrapWithKeys(pConn, pub, priv, elligator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key exchange done, but we never say who we are
+	conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatalf("host did not hang up on a connection that never logged in: %v", err)
+	}
+	network.waitUntil("the silent connection's slot to be released", func() bool {
+		return network.state.Pending.Pending("127.0.0.1") == 0
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var credentialCheck = []byte("andromeda credentials v1")
+
+// Profile is a saved network the client can join from the main screen
+type Profile struct {
+	Name        string
+	Server      string
+	Username    string
+	HostKey     []byte // pinned host key, nil to confirm it on first connect
+	Identity    string
+	AutoConnect bool
+	Password    []byte // sealed by the CredentialStore, nil if not remembered
+}
+
+type Profiles struct {
+	CredentialSalt  []byte // nil until a credential passphrase has been set
+	CredentialCheck []byte // known plaintext sealed with it, to spot a wrong passphrase
+	Profiles        []Profile
+}
+
+func (profiles *Profiles) Find(name string) *Profile {
+	for i := range profiles.Profiles {
+		if profiles.Profiles[i].Name == name {
+			return &profiles.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// Put adds profile or replaces the one of the same name
+func (profiles *Profiles) Put(profile Profile) {
+	if existing := profiles.Find(profile.Name); existing != nil {
+		*existing = profile
+		return
+	}
+	profiles.Profiles = append(profiles.Profiles, profile)
+	sort.Slice(profiles.Profiles, func(i, j int) bool {
+		return profiles.Profiles[i].Name < profiles.Profiles[j].Name
+	})
+}
+
+func (profiles *Profiles) Remove(name string) {
+	for i := range profiles.Profiles {
+		if profiles.Profiles[i].Name == name {
+			profiles.Profiles = append(profiles.Profiles[:i], profiles.Profiles[i+1:]...)
+			return
+		}
+	}
+}
+
+func (state Andromeda) LoadProfiles() (*Profiles, error) {
+	profiles := &Profiles{}
+	path, err := state.configPath("profiles.json")
+	if err != nil {
+		return nil, err
+	}
+	if err := loadJSON(path, profiles); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+func (state Andromeda) SaveProfiles(profiles *Profiles) error {
+	path, err := state.configPath("profiles.json")
+	if err != nil {
+		return err
+	}
+	return saveJSON(path, profiles)
+}
+
+// CredentialStore seals remembered passwords with a key derived from a
+// passphrase the user enters once per run, independent of any OS keyring
+type CredentialStore struct {
+	mutex sync.Mutex
+	key   *[32]byte
+}
+
+func sealSecret(key *[32]byte, plain []byte) []byte {
+	var nonce [24]byte
+	copy(nonce[:], randomBytes(len(nonce)))
+	return secretbox.Seal(append([]byte{}, nonce[:]...), plain, &nonce, key)
+}
+
+func openSecret(key *[32]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < 24+secretbox.Overhead {
+		return nil, errors.New("sealed secret is truncated")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	plain, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong passphrase or corrupted secret")
+	}
+	return plain, nil
+}
+
+func (store *CredentialStore) Unlocked() bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.key != nil
+}
+
+// Unlock derives the credential key from passphrase; the first passphrase
+// ever given is set up as the one for profiles, which then must be saved
+func (store *CredentialStore) Unlock(profiles *Profiles, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("a credential passphrase is required")
+	}
+	setup := profiles.CredentialSalt == nil
+	salt := profiles.CredentialSalt
+	if setup {
+		salt = randomBytes(16)
+	}
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	if setup {
+		profiles.CredentialSalt = salt
+		profiles.CredentialCheck = sealSecret(key, credentialCheck)
+	} else if check, err := openSecret(key, profiles.CredentialCheck); err != nil || string(check) != string(credentialCheck) {
+		return errors.New("wrong credential passphrase")
+	}
+	store.mutex.Lock()
+	store.key = key
+	store.mutex.Unlock()
+	return nil
+}
+
+func (store *CredentialStore) Seal(password string) ([]byte, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.key == nil {
+		return nil, errors.New("credential store is locked")
+	}
+	return sealSecret(store.key, []byte(password)), nil
+}
+
+func (store *CredentialStore) Open(sealed []byte) (string, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.key == nil {
+		return "", errors.New("credential store is locked")
+	}
+	plain, err := openSecret(store.key, sealed)
+	return string(plain), err
+}
+
+// pinProfileHost stores key as the host key of profile name if it has none yet
+func (state Andromeda) pinProfileHost(name string, key []byte) error {
+	profiles, err := state.LoadProfiles()
+	if err != nil {
+		return err
+	}
+	profile := profiles.Find(name)
+	if profile == nil || profile.HostKey != nil {
+		return nil
+	}
+	profile.HostKey = append([]byte{}, key...)
+	return state.SaveProfiles(profiles)
+}
+
+// UnlockCredentials unlocks the credential store with passphrase, saving
+// the profiles if it was the first passphrase given
+func (state Andromeda) UnlockCredentials(passphrase string) error {
+	profiles, err := state.LoadProfiles()
+	if err != nil {
+		return err
+	}
+	setup := profiles.CredentialSalt == nil
+	if err := state.Credentials.Unlock(profiles, passphrase); err != nil {
+		return err
+	}
+	if setup {
+		if err := state.SaveProfiles(profiles); err != nil {
+			return err
+		}
+		state.Log.With("main").Info("Set up credential passphrase")
+	}
+	return nil
+}
+
+// profileJoins builds the requests to connect with the profiles called
+// names. If one of them needs a remembered password while the credential
+// store is locked, it gives up and reports locked, so all of them can be
+// tried again once it is unlocked.
+func (state Andromeda) profileJoins(names []string) (joins []NetReqJoin, locked bool, errs []error) {
+	profiles, err := state.LoadProfiles()
+	if err != nil {
+		return nil, false, []error{err}
+	}
+	for _, name := range names {
+		profile := profiles.Find(name)
+		if profile == nil {
+			errs = append(errs, errors.New("No such profile '"+name+"'"))
+			continue
+		}
+		if profile.Password != nil && !state.Credentials.Unlocked() {
+			return nil, true, errs
+		}
+		join, err := profile.Join(state.Credentials)
+		if err != nil {
+			errs = append(errs, errors.New("Can't use profile '"+name+"': "+err.Error()))
+			continue
+		}
+		joins = append(joins, join)
+	}
+	return
+}
+
+// Join builds the request to connect with profile, opening its remembered
+// password with store
+func (profile Profile) Join(store *CredentialStore) (NetReqJoin, error) {
+	join := NetReqJoin{
+		Profile:  profile.Name,
+		Server:   profile.Server,
+		Username: profile.Username,
+		Identity: profile.Identity,
+		HostKey:  profile.HostKey,
+	}
+	if join.Identity == "" {
+		join.Identity = DefaultIdentity
+	}
+	if profile.Password != nil {
+		password, err := store.Open(profile.Password)
+		if err != nil {
+			return join, err
+		}
+		join.Password = password
+	}
+	return join, nil
+}
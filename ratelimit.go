@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	loginHistorySize   = 50
+	loginTableSize     = 10000 // tracked IPs/usernames before stale ones are pruned
+	loginAlertInterval = 10 * time.Minute
+)
+
+type LoginLimitConfig struct {
+	FreeFailures int           // failures before lockouts start
+	BaseLockout  time.Duration // first lockout, doubled on every further failure
+	MaxLockout   time.Duration
+	Forget       time.Duration // failures older than this no longer count
+}
+
+var DefaultLoginLimitConfig = LoginLimitConfig{
+	FreeFailures: 3,
+	BaseLockout:  2 * time.Second,
+	MaxLockout:   15 * time.Minute,
+	Forget:       time.Hour,
+}
+
+type FailedLogin struct {
+	Time     time.Time
+	Remote   string
+	Username string
+	Reason   string
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter tracks failed logins per remote IP and per username and
+// locks either out for exponentially growing periods
+type LoginLimiter struct {
+	sync.Mutex
+	config LoginLimitConfig
+	byIP   map[string]*loginFailures
+	byUser map[string]*loginFailures
+	recent []FailedLogin
+	now    func() time.Time
+
+	lockouts  int // triggered so far
+	unalerted int // triggered since the operator was last alerted
+	alerted   time.Time
+}
+
+func NewLoginLimiter(config LoginLimitConfig) *LoginLimiter {
+	return &LoginLimiter{
+		config: config,
+		byIP:   make(map[string]*loginFailures),
+		byUser: make(map[string]*loginFailures),
+		now:    time.Now,
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (limiter *LoginLimiter) entry(table map[string]*loginFailures, key string) *loginFailures {
+	now := limiter.now()
+	failures := table[key]
+	if failures == nil || now.Sub(failures.last) > limiter.config.Forget {
+		if len(table) >= loginTableSize {
+			for k, v := range table {
+				if now.Sub(v.last) > limiter.config.Forget || now.After(v.lockedUntil) && v.count < limiter.config.FreeFailures {
+					delete(table, k)
+				}
+			}
+		}
+		failures = &loginFailures{}
+		table[key] = failures
+	}
+	return failures
+}
+
+// LockedOut returns how long logins from ip or for username are still refused
+func (limiter *LoginLimiter) LockedOut(ip, username string) (wait time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+	for _, failures := range []*loginFailures{limiter.byIP[ip], limiter.byUser[username]} {
+		if failures != nil && failures.lockedUntil.Sub(now) > wait {
+			wait = failures.lockedUntil.Sub(now)
+		}
+	}
+	return
+}
+
+// Failure records a failed login and returns the lockout it triggered, if any
+func (limiter *LoginLimiter) Failure(ip, username, reason string) (lockout time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+
+	limiter.recent = append(limiter.recent, FailedLogin{now, ip, username, reason})
+	if len(limiter.recent) > loginHistorySize {
+		limiter.recent = limiter.recent[len(limiter.recent)-loginHistorySize:]
+	}
+
+	for _, failures := range []*loginFailures{limiter.entry(limiter.byIP, ip), limiter.entry(limiter.byUser, username)} {
+		failures.count++
+		failures.last = now
+		if excess := failures.count - limiter.config.FreeFailures; excess > 0 {
+			duration := limiter.config.BaseLockout
+			for i := 1; i < excess && duration < limiter.config.MaxLockout; i++ {
+				duration *= 2
+			}
+			if duration > limiter.config.MaxLockout {
+				duration = limiter.config.MaxLockout
+			}
+			failures.lockedUntil = now.Add(duration)
+			if duration > lockout {
+				lockout = duration
+			}
+		}
+	}
+	if lockout > 0 {
+		limiter.lockouts++
+		limiter.unalerted++
+	}
+	return
+}
+
+// Lockouts returns how many lockouts have been triggered
+func (limiter *LoginLimiter) Lockouts() int {
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.lockouts
+}
+
+// Alert returns the lockouts the operator hasn't been alerted to yet, at
+// most once per loginAlertInterval so rotating usernames or addresses can't
+// bury them in dialogs; 0 means no alert is due
+func (limiter *LoginLimiter) Alert() int {
+	limiter.Lock()
+	defer limiter.Unlock()
+	now := limiter.now()
+	if limiter.unalerted == 0 || !limiter.alerted.IsZero() && now.Sub(limiter.alerted) < loginAlertInterval {
+		return 0
+	}
+	n := limiter.unalerted
+	limiter.unalerted = 0
+	limiter.alerted = now
+	return n
+}
+
+// Success clears the failure count for username; the IP keeps its record so
+// one valid account can't be used to reset guessing against others
+func (limiter *LoginLimiter) Success(username string) {
+	limiter.Lock()
+	delete(limiter.byUser, username)
+	limiter.Unlock()
+}
+
+// Recent returns the latest failed logins, newest first
+func (limiter *LoginLimiter) Recent(n int) (failed []FailedLogin) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	for i := len(limiter.recent) - 1; i >= 0 && len(failed) < n; i-- {
+		failed = append(failed, limiter.recent[i])
+	}
+	return
+}
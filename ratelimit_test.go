@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockoutAlertsCollapse(t *testing.T) {
+	limiter := NewLoginLimiter(LoginLimitConfig{FreeFailures: 0, BaseLockout: time.Second, MaxLockout: time.Minute, Forget: time.Hour})
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+
+	if limiter.Alert() != 0 {
+		t.Error("alert without any lockout")
+	}
+	// an attacker rotating addresses and usernames
+	for i := 0; i < 20; i++ {
+		limiter.Failure(fmt.Sprintf("10.0.0.%d", i), fmt.Sprintf("user%d", i), "wrong password")
+	}
+	if n := limiter.Alert(); n != 20 {
+		t.Errorf("first alert covers %d lockouts, want 20", n)
+	}
+	for i := 0; i < 20; i++ {
+		limiter.Failure(fmt.Sprintf("10.0.1.%d", i), fmt.Sprintf("other%d", i), "wrong password")
+		if n := limiter.Alert(); n != 0 {
+			t.Fatalf("alerted again after %d more lockouts", i+1)
+		}
+	}
+	now = now.Add(loginAlertInterval)
+	if n := limiter.Alert(); n != 20 {
+		t.Errorf("later alert covers %d lockouts, want 20", n)
+	}
+	if n := limiter.Lockouts(); n != 40 {
+		t.Errorf("counted %d lockouts, want 40", n)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const registrationTTL = 10 * time.Minute
+
+type PendingRegistration struct {
+	ID       int
+	Username string
+	PubKey   []byte
+	Verifier *ScramVerifier
+	Time     time.Time
+	Session  *Session // the connection waiting for the decision
+}
+
+func (registration *PendingRegistration) Expires() time.Time {
+	return registration.Time.Add(registrationTTL)
+}
+
+func (registration *PendingRegistration) Message() MessageRegistrationRequest {
+	return MessageRegistrationRequest{
+		ID:       registration.ID,
+		Username: registration.Username,
+		PubKey:   registration.PubKey,
+		Remote:   registration.Session.Remote,
+		Expires:  registration.Expires(),
+	}
+}
+
+// RegistrationQueue holds registration requests until the host decides on
+// them, in any order, or they go stale
+type RegistrationQueue struct {
+	sync.Mutex
+	next    int
+	pending map[int]*PendingRegistration
+}
+
+func NewRegistrationQueue() *RegistrationQueue {
+	return &RegistrationQueue{pending: make(map[int]*PendingRegistration)}
+}
+
+func (queue *RegistrationQueue) Add(registration *PendingRegistration) int {
+	queue.Lock()
+	defer queue.Unlock()
+	queue.next++
+	registration.ID = queue.next
+	queue.pending[registration.ID] = registration
+	return registration.ID
+}
+
+// Take removes a request from the queue, nil if it was already handled
+func (queue *RegistrationQueue) Take(id int) *PendingRegistration {
+	queue.Lock()
+	defer queue.Unlock()
+	registration := queue.pending[id]
+	delete(queue.pending, id)
+	return registration
+}
+
+// List returns the outstanding requests, oldest first
+func (queue *RegistrationQueue) List() (registrations []*PendingRegistration) {
+	queue.Lock()
+	defer queue.Unlock()
+	for _, registration := range queue.pending {
+		registrations = append(registrations, registration)
+	}
+	sort.Slice(registrations, func(i, j int) bool {
+		return registrations[i].ID < registrations[j].ID
+	})
+	return
+}
+
+func (queue *RegistrationQueue) Len() int {
+	queue.Lock()
+	defer queue.Unlock()
+	return len(queue.pending)
+}
+
+// Expire removes and returns every request older than registrationTTL
+func (queue *RegistrationQueue) Expire(now time.Time) (expired []*PendingRegistration) {
+	queue.Lock()
+	defer queue.Unlock()
+	for id, registration := range queue.pending {
+		if now.After(registration.Expires()) {
+			expired = append(expired, registration)
+			delete(queue.pending, id)
+		}
+	}
+	return
+}
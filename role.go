@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Role int
+
+// Ordered by rank, later roles may act on earlier ones
+const (
+	RoleGuest Role = iota
+	RoleMember
+	RoleAdmin
+	RoleOwner
+)
+
+var roleNames = []string{"guest", "member", "admin", "owner"}
+
+func (role Role) String() string {
+	if role < RoleGuest || role > RoleOwner {
+		return fmt.Sprintf("role(%d)", int(role))
+	}
+	return roleNames[role]
+}
+
+func ParseRole(name string) (Role, error) {
+	for i, k := range roleNames {
+		if strings.EqualFold(name, k) {
+			return Role(i), nil
+		}
+	}
+	return RoleGuest, fmt.Errorf("unknown role '%s'", name)
+}
+
+type Permission int
+
+const (
+	PermissionChat                 Permission = iota // broadcast chat to the network
+	PermissionPublishServices                        // announce services to other members
+	PermissionRelay                                  // route traffic through the host
+	PermissionApproveRegistrations                   // decide on pending registration requests
+	PermissionKick                                   // drop other users' sessions
+	PermissionManageRoles                            // change other users' roles
+	PermissionViewMembers                            // list users and their sessions
+	PermissionConfigureHost                          // change the host's settings
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleGuest:  {PermissionChat},
+	RoleMember: {PermissionChat, PermissionPublishServices, PermissionRelay},
+	RoleAdmin: {PermissionChat, PermissionPublishServices, PermissionRelay,
+		PermissionApproveRegistrations, PermissionKick, PermissionViewMembers},
+	RoleOwner: {PermissionChat, PermissionPublishServices, PermissionRelay,
+		PermissionApproveRegistrations, PermissionKick, PermissionViewMembers,
+		PermissionManageRoles, PermissionConfigureHost},
+}
+
+func (role Role) Can(permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Outranks reports whether role may kick or demote a user holding other;
+// owners can act on each other, everyone else only on lower roles
+func (role Role) Outranks(other Role) bool {
+	return role > other || role == RoleOwner
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/layout"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+	"robpike.io/filter"
+)
+
+// Screens builds the content of the main window, one method per screen; the
+// callbacks only talk to the rest of the program through the event buses, so
+// a screen can be rendered and clicked through without a running network
+type Screens struct {
+	state   Andromeda
+	channel chan Event // GUI bus
+	win     fyne.Window
+	log     *Logger
+}
+
+// Main lists hosted, joined and saved networks
+func (screens *Screens) Main() fyne.CanvasObject {
+	hosted := widget.NewVBox()
+	for _, config := range screens.state.Hosts.List() {
+		id := config.ID
+		hosted.Append(widget.NewHBox(
+			widget.NewLabel(fmt.Sprintf("'%s' on %s", config.Name, config.Address)),
+			layout.NewSpacer(),
+			widget.NewButtonWithIcon("Open", theme.NavigateNextIcon(), func() {
+				screens.channel <- Event{
+					GuiEventShowHostReady,
+					GuiReqShowHostReady{id},
+				}
+			}),
+			widget.NewButtonWithIcon("Stop", theme.CancelIcon(), func() {
+				screens.state.NetBus <- Event{
+					NetEventStopHost,
+					NetReqStopHost{id},
+				}
+			}),
+		))
+	}
+
+	networks := widget.NewVBox()
+	for _, client := range screens.state.Clients.List() {
+		id := client.ID
+		client.Lock()
+		role := client.Role
+		client.Unlock()
+		networks.Append(widget.NewHBox(
+			widget.NewLabel(fmt.Sprintf("'%s' on %s (%s)", client.Username, client.Server, role)),
+			layout.NewSpacer(),
+			widget.NewButtonWithIcon("Open", theme.NavigateNextIcon(), func() {
+				screens.channel <- Event{
+					GuiEventShowSession,
+					GuiReqShowSession{id, ""},
+				}
+			}),
+			widget.NewButtonWithIcon("Leave", theme.CancelIcon(), func() {
+				screens.state.NetBus <- Event{
+					NetEventLeave,
+					NetReqLeave{id},
+				}
+			}),
+		))
+	}
+
+	saved := widget.NewVBox()
+	profiles, err := screens.state.LoadProfiles()
+	if err != nil {
+		screens.log.Error("Can't load profiles", "error", err)
+		profiles = &Profiles{}
+	}
+	for _, profile := range profiles.Profiles {
+		name := profile.Name
+		description := fmt.Sprintf("%s: '%s' on %s", name, profile.Username, profile.Server)
+		if profile.AutoConnect {
+			description += ", automatic"
+		}
+		saved.Append(widget.NewHBox(
+			widget.NewLabel(description),
+			layout.NewSpacer(),
+			widget.NewButtonWithIcon("Connect", theme.NavigateNextIcon(), func() {
+				screens.channel <- Event{
+					GuiEventConnectProfiles,
+					GuiReqConnectProfiles{[]string{name}},
+				}
+			}),
+			widget.NewButton("Edit", func() {
+				screens.channel <- Event{
+					GuiEventShowJoin,
+					GuiReqShowJoin{name},
+				}
+			}),
+			widget.NewButtonWithIcon("Delete", theme.DeleteIcon(), func() {
+				dialog.ShowConfirm("Delete profile", "Delete the saved profile '"+name+"'?", func(ok bool) {
+					if !ok {
+						return
+					}
+					profiles, err := screens.state.LoadProfiles()
+					if err == nil {
+						profiles.Remove(name)
+						err = screens.state.SaveProfiles(profiles)
+					}
+					if err != nil {
+						dialog.ShowError(err, screens.win)
+						return
+					}
+					screens.log.Info("Deleted profile", "profile", name)
+					screens.channel <- Event{
+						GuiEventShowMain,
+						GuiReqShowMain{},
+					}
+				}, screens.win)
+			}),
+		))
+	}
+
+	content := widget.NewVBox(
+		widget.NewLabelWithStyle("Andromeda - A specific nebula", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+		layout.NewSpacer(),
+		widget.NewHBox(
+			layout.NewSpacer(),
+			widget.NewHyperlink("code", parseURL("https://github.com/coderobe/andromeda")),
+			layout.NewSpacer(),
+		),
+		layout.NewSpacer(),
+	)
+	if len(hosted.Children) > 0 {
+		content.Append(widget.NewGroup("Hosted networks", hosted))
+	}
+	if len(networks.Children) > 0 {
+		content.Append(widget.NewGroup("Connected networks", networks))
+	}
+	if len(saved.Children) > 0 {
+		content.Append(widget.NewGroup("Saved networks", saved))
+	}
+	content.Append(widget.NewLabelWithStyle("Create a network by selecting `Host` ...", fyne.TextAlignCenter, fyne.TextStyle{}))
+	content.Append(widget.NewLabelWithStyle("...or join one with `Join`", fyne.TextAlignCenter, fyne.TextStyle{}))
+	content.Append(layout.NewSpacer())
+	content.Append(widget.NewHBox(
+		layout.NewSpacer(),
+		widget.NewButton("Identity", func() {
+			screens.channel <- Event{
+				GuiEventShowIdentity,
+				GuiReqShowIdentity{DefaultIdentity, ""},
+			}
+		}),
+		widget.NewButton("Logs", func() {
+			screens.channel <- Event{
+				GuiEventShowLog,
+				GuiReqShowLog{LogLevelInfo},
+			}
+		}),
+		layout.NewSpacer(),
+	))
+	content.Append(fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+		widget.NewButtonWithIcon("Host", theme.HomeIcon(), func() {
+			screens.channel <- Event{
+				GuiEventShowHost,
+				GuiReqShowHost{},
+			}
+		}),
+		widget.NewButtonWithIcon("Join", theme.NavigateNextIcon(), func() {
+			screens.channel <- Event{
+				GuiEventShowJoin,
+				GuiReqShowJoin{},
+			}
+		}),
+	))
+	return content
+}
+
+// Host asks for the name and address of a network to host
+func (screens *Screens) Host() fyne.CanvasObject {
+	name := widget.NewEntry()
+	name.SetPlaceHolder("default")
+	name.SetText("default")
+	server := widget.NewEntry()
+	server.SetPlaceHolder("localhost:1234")
+	server.SetText("localhost:1234")
+
+	form := &widget.Form{
+		OnSubmit: func() {
+			screens.channel <- Event{
+				GuiEventShowMessage,
+				GuiReqShowMessage{
+					"Host",
+					"Starting server...",
+				},
+			}
+			screens.state.NetBus <- Event{
+				NetEventHost,
+				NetReqHost{
+					name.Text,
+					server.Text,
+				},
+			}
+		},
+		OnCancel: func() {
+			screens.channel <- Event{
+				GuiEventShowMain,
+				GuiReqShowMain{},
+			}
+		},
+	}
+	form.Append("Network name", name)
+	form.Append("Listen address:port", server)
+
+	return widget.NewGroup("Create network", form)
+}
+
+// HostReady is the dashboard of a network we host
+func (screens *Screens) HostReady(config *HostConfig) fyne.CanvasObject {
+	config.Lock()
+	userNames := filter.Apply(config.Users, func(u *User) string {
+		return u.Name
+	}).([]string)
+	config.Unlock()
+
+	// settings change through the net handler so they are audited; the
+	// screen is rebuilt when someone else changes them
+	settings := config.Settings()
+	applySettings := func() {
+		screens.state.NetBus <- Event{
+			NetEventSettings,
+			NetReqSettings{config.ID, settings},
+		}
+	}
+	registrationCheck := widget.NewCheck("Enable registration requests", func(b bool) {
+		settings.RegistrationEnabled = b
+		applySettings()
+	})
+	registrationCheck.Checked = settings.RegistrationEnabled
+	keyAuthCheck := widget.NewCheck("Allow login by pinned key alone", func(b bool) {
+		if b {
+			settings.AuthMode = AuthModeKey
+		} else {
+			settings.AuthMode = AuthModePassword
+		}
+		applySettings()
+	})
+	keyAuthCheck.Checked = settings.AuthMode == AuthModeKey
+	adminsNeedBothCheck := widget.NewCheck("Admins need key and password", func(b bool) {
+		settings.AdminsNeedBoth = b
+		applySettings()
+	})
+	adminsNeedBothCheck.Checked = settings.AdminsNeedBoth
+
+	selectedUser := ""
+	roleSelect := widget.NewSelect(roleNames, func(name string) {
+		role, err := ParseRole(name)
+		if err != nil {
+			return
+		}
+		config.Lock()
+		user := config.findUser(selectedUser)
+		changed := user != nil && user.Role != role
+		config.Unlock()
+		if changed {
+			screens.state.NetBus <- Event{
+				NetEventSetRole,
+				NetReqSetRole{config.ID, selectedUser, role},
+			}
+		}
+	})
+	kickButton := widget.NewButton("Kick", func() {
+		if selectedUser == "" {
+			return
+		}
+		screens.state.NetBus <- Event{
+			NetEventKick,
+			NetReqKick{config.ID, selectedUser, ""},
+		}
+	})
+	verifyButton := widget.NewButton("Verify", func() {
+		if selectedUser == "" {
+			return
+		}
+		config.Lock()
+		var words []string
+		if user := config.findUser(selectedUser); user != nil && user.Session != nil {
+			words = user.Session.Sas
+		}
+		config.Unlock()
+		if words == nil {
+			screens.channel <- Event{
+				GuiEventShowAlert,
+				GuiReqShowAlert{"Verify", "'" + selectedUser + "' has to be logged in to compare verification words."},
+			}
+			return
+		}
+		screens.channel <- Event{
+			GuiEventShowVerify,
+			GuiReqShowVerify{
+				config.ID,
+				0,
+				selectedUser,
+				words,
+			},
+		}
+	})
+	userSelect := widget.NewSelect(userNames, func(username string) {
+		selectedUser = username
+		config.Lock()
+		role := RoleGuest
+		if user := config.findUser(username); user != nil {
+			role = user.Role
+		}
+		config.Unlock()
+		roleSelect.SetSelected(role.String())
+	})
+
+	failedLogins := widget.NewVBox()
+	for _, failed := range config.Logins.Recent(5) {
+		failedLogins.Append(widget.NewLabelWithStyle(
+			fmt.Sprintf("%s  %s  '%s'  %s", failed.Time.Format("15:04:05"), failed.Remote, failed.Username, failed.Reason),
+			fyne.TextAlignLeading,
+			fyne.TextStyle{Monospace: true},
+		))
+	}
+	if len(failedLogins.Children) == 0 {
+		failedLogins.Append(widget.NewLabelWithStyle("None", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+	}
+	failedLoginsTitle := "Recent failed logins"
+	if lockouts := config.Logins.Lockouts(); lockouts > 0 {
+		failedLoginsTitle += fmt.Sprintf(" (%d lockouts)", lockouts)
+	}
+
+	hostKey := widget.NewVBox(
+		widget.NewLabelWithStyle("Your host is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+		layout.NewSpacer(),
+		widget.NewLabelWithStyle(FormatFingerprint(config.PubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+		layout.NewSpacer(),
+	)
+	share := widget.NewHBox(hostKey)
+	joinAddress, err := config.JoinAddress()
+	if joinAddress != "" {
+		joinLink := JoinLink{joinAddress, config.PubKey, ""}.String()
+		hostKey.Append(widget.NewLabelWithStyle("Share this with your users,\nor give them the join link:", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+		hostKey.Append(widget.NewLabelWithStyle(strings.Replace(joinLink, "?", "\n?", 1), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}))
+		hostKey.Append(widget.NewButtonWithIcon("Copy join link", theme.ContentCopyIcon(), func() {
+			screens.win.Clipboard().SetContent(joinLink)
+		}))
+		share.Append(qrCode(joinLink, 192))
+	}
+	if err != nil {
+		hostKey.Append(widget.NewLabelWithStyle(err.Error(), fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+	}
+
+	return widget.NewVBox(
+		widget.NewGroup("'"+config.Name+"' accepting connections", share),
+		layout.NewSpacer(),
+		widget.NewGroup("Registrations",
+			fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+				widget.NewButton(fmt.Sprintf("Pending requests (%d)", config.Registrations.Len()), func() {
+					screens.channel <- Event{
+						GuiEventShowHostRegistrations,
+						GuiReqShowHostRegistrations{config.ID},
+					}
+				}),
+				widget.NewButton("Invites", func() {
+					screens.channel <- Event{
+						GuiEventShowHostInvites,
+						GuiReqShowHostInvites{config.ID},
+					}
+				}),
+			),
+		),
+		widget.NewGroup(failedLoginsTitle, failedLogins),
+		widget.NewGroup("Configuration",
+			widget.NewHBox(
+				layout.NewSpacer(),
+				widget.NewVBox(
+					registrationCheck,
+					keyAuthCheck,
+					adminsNeedBothCheck,
+				),
+				layout.NewSpacer(),
+			),
+			fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+				widget.NewGroup("User Config",
+					widget.NewHBox(
+						layout.NewSpacer(),
+						userSelect,
+						roleSelect,
+						verifyButton,
+						kickButton,
+						layout.NewSpacer(),
+					),
+				),
+				widget.NewGroup("Host Config",
+					widget.NewButton("Edit", func() {
+						screens.log.Debug("Host edit") // todo handle
+					}),
+					widget.NewButton("Logs", func() {
+						screens.channel <- Event{
+							GuiEventShowLog,
+							GuiReqShowLog{LogLevelInfo},
+						}
+					}),
+					widget.NewButton("Audit log", func() {
+						screens.channel <- Event{
+							GuiEventShowAudit,
+							GuiReqShowAudit{config.ID, AuditFilter{}},
+						}
+					}),
+				),
+			),
+		),
+		fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+			widget.NewButtonWithIcon("Networks", theme.NavigateBackIcon(), func() {
+				screens.channel <- Event{
+					GuiEventShowMain,
+					GuiReqShowMain{},
+				}
+			}),
+			widget.NewButtonWithIcon("Stop hosting", theme.CancelIcon(), func() {
+				dialog.ShowConfirm("Stop hosting", "Disconnect everyone from '"+config.Name+"' and stop hosting it?", func(ok bool) {
+					if !ok {
+						return
+					}
+					screens.state.NetBus <- Event{
+						NetEventStopHost,
+						NetReqStopHost{config.ID},
+					}
+					screens.channel <- Event{
+						GuiEventShowMain,
+						GuiReqShowMain{},
+					}
+				}, screens.win)
+			}),
+		),
+	)
+}
+
+// Join is the login form, filled in from profile name if there is one
+func (screens *Screens) Join(name string) fyne.CanvasObject {
+	profiles, err := screens.state.LoadProfiles()
+	if err != nil {
+		screens.log.Error("Can't load profiles", "error", err)
+		profiles = &Profiles{}
+	}
+	var editing Profile
+	if name != "" {
+		if profile := profiles.Find(name); profile != nil {
+			editing = *profile
+		}
+	}
+
+	server := widget.NewEntry()
+	server.SetPlaceHolder("example.org:1234")
+	server.SetText(editing.Server)
+	username := widget.NewEntry()
+	username.SetPlaceHolder("JohnDoe")
+	username.SetText(editing.Username)
+	password := widget.NewPasswordEntry()
+	password.SetPlaceHolder("empty to log in by key")
+	if editing.Password != nil {
+		if remembered, err := screens.state.Credentials.Open(editing.Password); err == nil {
+			password.SetText(remembered)
+		} else {
+			password.SetPlaceHolder("remembered, empty to keep")
+		}
+	}
+	separateIdentity := widget.NewCheck("Use a separate identity for this network", nil)
+	separateIdentity.Checked = editing.Identity != "" && editing.Identity != DefaultIdentity
+	joinLink := widget.NewEntry()
+	joinLink.SetPlaceHolder("andromeda://... (optional)")
+	pasteJoinLink := widget.NewButtonWithIcon("Paste", theme.ContentPasteIcon(), func() {
+		joinLink.SetText(screens.win.Clipboard().Content())
+	})
+	joinLinkStatus := widget.NewLabel("")
+	joinLink.OnChanged = func(text string) {
+		link, err := ParseJoinLink(text)
+		switch {
+		case text == "":
+			joinLinkStatus.SetText("")
+		case err != nil:
+			joinLinkStatus.SetText("Invalid join link")
+		default:
+			server.SetText(link.Server)
+			if link.Invite != "" {
+				joinLinkStatus.SetText("Host key pinned, invite included")
+			} else {
+				joinLinkStatus.SetText("Host key pinned")
+			}
+		}
+	}
+
+	fingerprint := widget.NewMultiLineEntry()
+	fingerprint.SetPlaceHolder("host key words (optional)")
+	fingerprintStatus := widget.NewLabel("")
+	fingerprint.OnChanged = func(text string) {
+		if strings.TrimSpace(text) == "" {
+			fingerprintStatus.SetText("")
+		} else if _, err := DecodeFingerprint(text); err != nil {
+			fingerprintStatus.SetText(err.Error())
+		} else {
+			fingerprintStatus.SetText("Host key pinned")
+		}
+	}
+	if editing.HostKey != nil {
+		fingerprint.SetText(FormatFingerprint(editing.HostKey, 4))
+	}
+
+	profileName := widget.NewEntry()
+	profileName.SetPlaceHolder("empty to not save")
+	profileName.SetText(editing.Name)
+	rememberPassword := widget.NewCheck("Remember password", nil)
+	rememberPassword.Checked = editing.Password != nil
+	autoConnect := widget.NewCheck("Connect automatically on start", nil)
+	autoConnect.Checked = editing.AutoConnect
+	passphrase := widget.NewPasswordEntry()
+	passphrase.SetPlaceHolder("protects remembered passwords")
+
+	form := &widget.Form{
+		OnSubmit: func() {
+			if server.Text == "" || username.Text == "" {
+				dialog.ShowError(errors.New("Server and username are required"), screens.win)
+				return
+			}
+			var hostKey []byte
+			var invite string
+			if link, err := ParseJoinLink(joinLink.Text); err == nil && link.Server == server.Text {
+				hostKey = link.HostKey
+				invite = link.Invite
+			}
+			if strings.TrimSpace(fingerprint.Text) != "" {
+				key, err := DecodeFingerprint(fingerprint.Text)
+				if err != nil {
+					dialog.ShowError(errors.New("Invalid host fingerprint: "+err.Error()), screens.win)
+					return
+				}
+				if hostKey != nil && string(hostKey) != string(key) {
+					dialog.ShowError(errors.New("The host fingerprint does not match the join link"), screens.win)
+					return
+				}
+				hostKey = key
+			}
+			identity := DefaultIdentity
+			if separateIdentity.Checked {
+				identity = IdentityNameForServer(server.Text)
+			}
+			secret := password.Text
+			if secret == "" && editing.Password != nil && rememberPassword.Checked {
+				remembered, err := screens.state.Credentials.Open(editing.Password)
+				if err != nil {
+					dialog.ShowError(errors.New("Unlock your credentials to use the remembered password"), screens.win)
+					return
+				}
+				secret = remembered
+			}
+
+			if profileName.Text != "" {
+				profile := Profile{
+					Name:        profileName.Text,
+					Server:      server.Text,
+					Username:    username.Text,
+					HostKey:     hostKey,
+					Identity:    identity,
+					AutoConnect: autoConnect.Checked,
+				}
+				if rememberPassword.Checked && secret != "" {
+					if !screens.state.Credentials.Unlocked() {
+						if err := screens.state.Credentials.Unlock(profiles, passphrase.Text); err != nil {
+							dialog.ShowError(err, screens.win)
+							return
+						}
+					}
+					sealed, err := screens.state.Credentials.Seal(secret)
+					if err != nil {
+						dialog.ShowError(err, screens.win)
+						return
+					}
+					profile.Password = sealed
+				}
+				if editing.Name != "" && editing.Name != profile.Name {
+					profiles.Remove(editing.Name)
+				}
+				profiles.Put(profile)
+				if err := screens.state.SaveProfiles(profiles); err != nil {
+					dialog.ShowError(errors.New("Can't save profile: "+err.Error()), screens.win)
+					return
+				}
+				screens.log.Info("Saved profile", "profile", profile.Name, "server", profile.Server)
+			}
+
+			screens.channel <- Event{
+				GuiEventShowMessage,
+				GuiReqShowMessage{
+					"Join",
+					"Connecting to network...",
+				},
+			}
+			screens.state.NetBus <- Event{
+				NetEventJoin,
+				NetReqJoin{
+					profileName.Text,
+					server.Text,
+					username.Text,
+					secret,
+					identity,
+					hostKey,
+					invite,
+				},
+			}
+		},
+		OnCancel: func() {
+			screens.channel <- Event{
+				GuiEventShowMain,
+				GuiReqShowMain{},
+			}
+		},
+	}
+	form.Append("Join link", fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, nil, pasteJoinLink), pasteJoinLink, joinLink))
+	form.Append("", joinLinkStatus)
+	form.Append("Server", server)
+	form.Append("Fingerprint", fingerprint)
+	form.Append("", fingerprintStatus)
+	form.Append("Username", username)
+	form.Append("Password", password)
+	form.Append("Identity", separateIdentity)
+	form.Append("Save as", profileName)
+	form.Append("", rememberPassword)
+	form.Append("", autoConnect)
+	if !screens.state.Credentials.Unlocked() {
+		form.Append("Credential passphrase", passphrase)
+	}
+
+	return widget.NewGroup("Login", widget.NewScrollContainer(form))
+}
+
+// JoinUnknownConnection asks whether to trust the key client's server presented
+func (screens *Screens) JoinUnknownConnection(client *ClientConfig, keyChanged bool) fyne.CanvasObject {
+	warning := layout.NewSpacer()
+	if keyChanged {
+		warning = widget.NewLabelWithStyle("WARNING: this is not the key this host presented before!", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+	}
+	return widget.NewGroup("Confirm network keys",
+		widget.NewVBox(
+			widget.NewLabelWithStyle(client.Server+" is presenting this key:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+			layout.NewSpacer(),
+			widget.NewLabelWithStyle(FormatFingerprint(client.TheirPubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+			layout.NewSpacer(),
+			widget.NewLabelWithStyle("If this is not the same key the host sees,\nyour connection might be intercepted.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+			layout.NewSpacer(),
+			warning,
+
+			widget.NewGroup("Continue connecting?",
+				fyne.NewContainerWithLayout(layout.NewGridLayout(2),
+					widget.NewButton("Abort", func() {
+						screens.log.Info("Cancelling connection")
+						screens.state.NetBus <- Event{
+							NetEventJoinUnknownConnection,
+							NetReqJoinUnknownConnection{client.ID, false},
+						}
+					}),
+					widget.NewButton("Continue", func() {
+						screens.log.Info("Continuing connection")
+						screens.state.NetBus <- Event{
+							NetEventJoinUnknownConnection,
+							NetReqJoinUnknownConnection{client.ID, true},
+						}
+					}),
+				),
+			),
+		),
+	)
+}
+
+// JoinOurHostKey shows the key client identifies with, for the host to compare
+func (screens *Screens) JoinOurHostKey(client *ClientConfig) fyne.CanvasObject {
+	return widget.NewGroup("Confirm network keys",
+		widget.NewVBox(
+			widget.NewLabelWithStyle("Your client is identifying as:", fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+			layout.NewSpacer(),
+			widget.NewLabelWithStyle(FormatFingerprint(client.OurPubKey, 4), fyne.TextAlignCenter, fyne.TextStyle{Monospace: true}),
+			layout.NewSpacer(),
+			widget.NewLabelWithStyle("Please share this with your host\nto verify your connection.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}),
+		),
+	)
+}
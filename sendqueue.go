@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PriorityControl = iota // auth, pings, kicks, registrations, admin results: always sent first
+	PriorityBulk           // member lists and chat, which can wait
+)
+
+// What a send queue does with bulk packets its peer can't keep up with;
+// control packets are never dropped, a peer that can't take those is cut off
+const (
+	SlowDrop       = iota // drop bulk packets that don't fit
+	SlowBlock             // make the producer wait for room, up to the timeout
+	SlowDisconnect        // hang up on the peer
+)
+
+var slowPolicyNames = []string{"drop", "block", "disconnect"}
+
+func ParseSlowPolicy(name string) (int, error) {
+	for i, k := range slowPolicyNames {
+		if strings.EqualFold(name, k) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy '%s'", name)
+}
+
+var (
+	ErrSendQueueFull   = errors.New("peer is not keeping up, send queue full")
+	ErrSendQueueClosed = errors.New("connection closed")
+)
+
+type SendQueueConfig struct {
+	Length  int           // packets of each priority waiting to be written
+	Timeout time.Duration // for a single write, and for producers waiting on a full queue
+	Policy  int           // for bulk packets that don't fit
+}
+
+var DefaultSendQueueConfig = SendQueueConfig{
+	Length:  64,
+	Timeout: 10 * time.Second,
+	Policy:  SlowDrop,
+}
+
+// packetPriority sorts packets into control and bulk traffic
+func packetPriority(packetID int) int {
+	switch packetID {
+	case packetAdminState, packetChat:
+		return PriorityBulk
+	}
+	return PriorityControl
+}
+
+type outgoing struct {
+	id      int
+	message interface{}
+}
+
+// SendQueue is the one goroutine writing to a connection. Anyone may Send
+// on it at any time; packets go out whole and control traffic goes first
+type SendQueue struct {
+	conn    net.Conn
+	config  SendQueueConfig
+	log     *Logger
+	metrics *Metrics
+	control chan outgoing
+	bulk    chan outgoing
+	closing chan struct{} // closed by Close, what is queued is still written
+	done    chan struct{} // closed once the writer has hung up
+	once    sync.Once
+	dropped uint64 // bulk packets dropped, atomic
+}
+
+func NewSendQueue(conn net.Conn, config SendQueueConfig, log *Logger, metrics *Metrics) *SendQueue {
+	if config.Length <= 0 {
+		config.Length = DefaultSendQueueConfig.Length
+	}
+	queue := &SendQueue{
+		conn:    conn,
+		config:  config,
+		log:     log,
+		metrics: metrics,
+		control: make(chan outgoing, config.Length),
+		bulk:    make(chan outgoing, config.Length),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go queue.write()
+	return queue
+}
+
+// Send queues a packet at the priority its type calls for
+func (queue *SendQueue) Send(packetID int, message interface{}) error {
+	return queue.SendPriority(packetPriority(packetID), packetID, message)
+}
+
+// SendPriority queues a packet. A full queue is reported to the producer
+// with ErrSendQueueFull, after waiting or dropping as the policy says
+func (queue *SendQueue) SendPriority(priority, packetID int, message interface{}) error {
+	select {
+	case <-queue.closing:
+		return ErrSendQueueClosed
+	case <-queue.done:
+		return ErrSendQueueClosed
+	default:
+	}
+	lane := queue.control
+	if priority == PriorityBulk {
+		lane = queue.bulk
+	}
+	packet := outgoing{packetID, message}
+	select {
+	case lane <- packet:
+		return nil
+	default:
+	}
+
+	if priority == PriorityBulk {
+		switch queue.config.Policy {
+		case SlowDrop:
+			queue.drop()
+			queue.log.Debug("Send queue full, dropping packet", "remote", queue.conn.RemoteAddr(), "type", packetID)
+			return ErrSendQueueFull
+		case SlowDisconnect:
+			queue.abort()
+			return ErrSendQueueFull
+		}
+	}
+	var timeout <-chan time.Time
+	if queue.config.Timeout > 0 {
+		timer := time.NewTimer(queue.config.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case lane <- packet:
+		return nil
+	case <-queue.closing:
+		return ErrSendQueueClosed
+	case <-queue.done:
+		return ErrSendQueueClosed
+	case <-timeout:
+		if priority == PriorityControl {
+			queue.abort()
+		} else {
+			queue.drop()
+		}
+		return ErrSendQueueFull
+	}
+}
+
+// Close hangs up once what is already queued has been written. It doesn't
+// wait for that, Done does
+func (queue *SendQueue) Close() error {
+	queue.once.Do(func() {
+		close(queue.closing)
+	})
+	return nil
+}
+
+// Done is closed once the connection has been hung up
+func (queue *SendQueue) Done() <-chan struct{} {
+	return queue.done
+}
+
+// Pending returns the packets waiting to be written
+func (queue *SendQueue) Pending() int {
+	return len(queue.control) + len(queue.bulk)
+}
+
+// Dropped returns how many bulk packets were given up on
+func (queue *SendQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&queue.dropped)
+}
+
+func (queue *SendQueue) drop() {
+	atomic.AddUint64(&queue.dropped, 1)
+	queue.metrics.Add("andromeda_send_dropped_total", "", 1)
+}
+
+// abort cuts off a peer that doesn't keep up, without flushing
+func (queue *SendQueue) abort() {
+	queue.metrics.Add("andromeda_send_disconnects_total", "", 1)
+	queue.log.Warn("Peer is not keeping up, disconnecting", "remote", queue.conn.RemoteAddr(), "pending", queue.Pending())
+	queue.conn.Close()
+	queue.Close()
+}
+
+func (queue *SendQueue) write() {
+	defer close(queue.done)
+	defer queue.conn.Close()
+	writer := &meteredWriter{w: queue.conn}
+	sendMessage := boundSendMessage(writer)
+	send := func(packet outgoing) bool {
+		if queue.config.Timeout > 0 {
+			queue.conn.SetWriteDeadline(time.Now().Add(queue.config.Timeout))
+		}
+		err := sendMessage(packet.id, packet.message)
+		queue.metrics.Packet("out", packet.id, writer.take())
+		if err != nil {
+			queue.log.Debug("Write failed, hanging up", "remote", queue.conn.RemoteAddr(), "error", err)
+			return false
+		}
+		return true
+	}
+	for {
+		var packet outgoing
+		select {
+		case packet = <-queue.control:
+		default:
+			select {
+			case packet = <-queue.control:
+			case packet = <-queue.bulk:
+			case <-queue.closing:
+				queue.flush(send)
+				return
+			}
+		}
+		if !send(packet) {
+			return
+		}
+	}
+}
+
+// flush writes out what was queued before Close, control traffic first
+func (queue *SendQueue) flush(send func(outgoing) bool) {
+	for {
+		var packet outgoing
+		select {
+		case packet = <-queue.control:
+		default:
+			select {
+			case packet = <-queue.bulk:
+			default:
+				return
+			}
+		}
+		if !send(packet) {
+			return
+		}
+	}
+}
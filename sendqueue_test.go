@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v4"
+)
+
+func newTestSendQueue(t *testing.T, config SendQueueConfig) (*SendQueue, net.Conn) {
+	t.Helper()
+	logger, err := NewLogger(LogConfig{Level: LogLevelError})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, theirs := net.Pipe()
+	queue := NewSendQueue(ours, config, logger, nil)
+	t.Cleanup(func() {
+		theirs.Close()
+		ours.Close()
+	})
+	return queue, theirs
+}
+
+// waitWriting waits until the writer took everything queued and is stuck
+// writing it to a peer that isn't reading
+func waitWriting(t *testing.T, queue *SendQueue) {
+	t.Helper()
+	deadline := time.Now().Add(harnessTimeout)
+	for queue.Pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer never picked up the first packet")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readPings(t *testing.T, conn net.Conn, count int) (ids []uint8, tokens []string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(harnessTimeout))
+	reader := bufio.NewReader(conn)
+	decoder := msgpack.NewDecoder(reader)
+	for i := 0; i < count; i++ {
+		packetID, packet, err := readPacket(reader, decoder)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		ids = append(ids, packetID)
+		if ping, ok := packet.(*MessagePing); ok {
+			tokens = append(tokens, ping.Token)
+		}
+	}
+	return
+}
+
+func TestSendQueueControlFirst(t *testing.T) {
+	queue, peer := newTestSendQueue(t, DefaultSendQueueConfig)
+	queue.Send(packetPing, MessagePing{"first"})
+	waitWriting(t, queue)
+	queue.Send(packetAdminState, MessageAdminState{})
+	queue.Send(packetAdminState, MessageAdminState{})
+	queue.Send(packetPing, MessagePing{"urgent"})
+
+	ids, tokens := readPings(t, peer, 4)
+	want := []uint8{packetPing, packetPing, packetAdminState, packetAdminState}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("packets arrived as %v, want %v", ids, want)
+		}
+	}
+	if tokens[0] != "first" || tokens[1] != "urgent" {
+		t.Errorf("pings arrived as %v", tokens)
+	}
+}
+
+func TestSendQueueDropsBulk(t *testing.T) {
+	queue, _ := newTestSendQueue(t, SendQueueConfig{Length: 1, Policy: SlowDrop})
+	queue.Send(packetAdminState, MessageAdminState{})
+	waitWriting(t, queue)
+	if err := queue.Send(packetAdminState, MessageAdminState{}); err != nil {
+		t.Fatalf("queueing into room failed: %v", err)
+	}
+	if err := queue.Send(packetAdminState, MessageAdminState{}); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("full queue returned %v", err)
+	}
+	if dropped := queue.Dropped(); dropped != 1 {
+		t.Errorf("%d packets dropped, want 1", dropped)
+	}
+	// control traffic has its own room
+	if err := queue.Send(packetPing, MessagePing{}); err != nil {
+		t.Errorf("control packet behind full bulk queue: %v", err)
+	}
+	// a dropped decision would leave the requester waiting forever
+	if packetPriority(packetRegistrationDecision) != PriorityControl || packetPriority(packetRegistrationRequest) != PriorityControl {
+		t.Error("registration packets can be dropped")
+	}
+}
+
+func TestSendQueueBlocksProducer(t *testing.T) {
+	queue, peer := newTestSendQueue(t, SendQueueConfig{Length: 1, Policy: SlowBlock})
+	queue.Send(packetPing, MessagePing{})
+	waitWriting(t, queue)
+	queue.Send(packetAdminState, MessageAdminState{})
+	sent := make(chan error)
+	go func() {
+		sent <- queue.Send(packetAdminState, MessageAdminState{})
+	}()
+	select {
+	case err := <-sent:
+		t.Fatalf("send into full queue returned %v instead of waiting", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	readPings(t, peer, 3)
+	if err := <-sent; err != nil {
+		t.Errorf("blocked send failed: %v", err)
+	}
+}
+
+func TestSendQueueDisconnectsSlowConsumer(t *testing.T) {
+	queue, _ := newTestSendQueue(t, SendQueueConfig{Length: 1, Policy: SlowDisconnect})
+	queue.Send(packetAdminState, MessageAdminState{})
+	waitWriting(t, queue)
+	queue.Send(packetAdminState, MessageAdminState{})
+	if err := queue.Send(packetAdminState, MessageAdminState{}); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("full queue returned %v", err)
+	}
+	select {
+	case <-queue.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatal("slow consumer was not disconnected")
+	}
+	if err := queue.Send(packetPing, MessagePing{}); !errors.Is(err, ErrSendQueueClosed) {
+		t.Errorf("send after disconnect returned %v", err)
+	}
+}
+
+func TestSendQueueControlTimeout(t *testing.T) {
+	queue, _ := newTestSendQueue(t, SendQueueConfig{Length: 1, Timeout: 50 * time.Millisecond})
+	var err error
+	for i := 0; i < 4 && err == nil; i++ {
+		err = queue.Send(packetPing, MessagePing{})
+	}
+	if !errors.Is(err, ErrSendQueueFull) && !errors.Is(err, ErrSendQueueClosed) {
+		t.Errorf("control packets to a stuck peer returned %v", err)
+	}
+	select {
+	case <-queue.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatal("stuck peer was not disconnected")
+	}
+}
+
+func TestSendQueueCloseFlushes(t *testing.T) {
+	queue, peer := newTestSendQueue(t, DefaultSendQueueConfig)
+	for _, token := range []string{"a", "b", "c"} {
+		queue.Send(packetPing, MessagePing{token})
+	}
+	queue.Send(packetKick, MessageKick{"admin", "bye"})
+	queue.Close()
+	if err := queue.Send(packetPing, MessagePing{"late"}); !errors.Is(err, ErrSendQueueClosed) {
+		t.Errorf("send after close returned %v", err)
+	}
+
+	ids, tokens := readPings(t, peer, 4)
+	if len(tokens) != 3 || tokens[0] != "a" || tokens[2] != "c" || ids[3] != packetKick {
+		t.Errorf("flushed %v %v", ids, tokens)
+	}
+	select {
+	case <-queue.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatal("connection not closed after flushing")
+	}
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Error("peer could still read after close")
+	}
+}
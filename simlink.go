@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LinkConditions describes a bad network link to simulate, for testing
+// keepalives, reconnects and transfers without a bad network at hand
+type LinkConditions struct {
+	Latency    time.Duration // one way delay added to everything written
+	Jitter     time.Duration // up to this much extra delay per write, order is kept
+	Loss       float64       // chance a write is lost and has to be sent again
+	Retransmit time.Duration // delay a lost write costs, like a TCP retransmission timeout
+	Bandwidth  int           // bytes per second sent, 0 for unlimited
+	ReadDelay  time.Duration // pause before every read, a slow reader
+	ReadChunk  int           // most bytes a single read returns, 0 for no limit
+	ResetAfter int64         // bytes written before the connection is reset, 0 for never
+	Seed       int64         // seeds jitter and loss so runs repeat
+}
+
+const (
+	defaultRetransmit = 200 * time.Millisecond
+	simQueueLength    = 64 // writes in flight before Write blocks
+	simCloseLinger    = time.Second
+)
+
+var ErrLinkReset = errors.New("connection reset by simulated link")
+
+// ParseLinkConditions reads comma separated key=value pairs, such as
+// "latency=100ms,jitter=20ms,loss=0.01,bandwidth=65536,read-chunk=16"
+func ParseLinkConditions(text string) (LinkConditions, error) {
+	var conditions LinkConditions
+	for _, pair := range strings.Split(text, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return conditions, fmt.Errorf("expected key=value, got '%s'", pair)
+		}
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "latency":
+			conditions.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			conditions.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			conditions.Loss, err = strconv.ParseFloat(value, 64)
+			if err == nil && (conditions.Loss < 0 || conditions.Loss > 1) {
+				err = errors.New("must be between 0 and 1")
+			}
+		case "retransmit":
+			conditions.Retransmit, err = time.ParseDuration(value)
+		case "bandwidth":
+			conditions.Bandwidth, err = strconv.Atoi(value)
+		case "read-delay":
+			conditions.ReadDelay, err = time.ParseDuration(value)
+		case "read-chunk":
+			conditions.ReadChunk, err = strconv.Atoi(value)
+		case "reset":
+			conditions.ResetAfter, err = strconv.ParseInt(value, 10, 64)
+		case "seed":
+			conditions.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return conditions, fmt.Errorf("unknown link condition '%s'", key)
+		}
+		if err != nil {
+			return conditions, fmt.Errorf("bad %s '%s': %v", key, value, err)
+		}
+	}
+	return conditions, nil
+}
+
+// Link applies the same conditions to every connection it wraps and keeps
+// track of them, so a test can cut them all at a point of its choosing
+type Link struct {
+	Conditions LinkConditions
+
+	sync.Mutex
+	wrapped int
+	conns   map[*SimConn]struct{}
+}
+
+func NewLink(conditions LinkConditions) *Link {
+	return &Link{Conditions: conditions, conns: make(map[*SimConn]struct{})}
+}
+
+// Wrap returns conn behind the simulated link; a nil link leaves it alone
+func (link *Link) Wrap(conn net.Conn) net.Conn {
+	if link == nil {
+		return conn
+	}
+	link.Lock()
+	defer link.Unlock()
+	// every connection gets its own, still repeatable, random stream
+	sim := newSimConn(conn, link, link.Conditions.Seed+int64(link.wrapped))
+	link.wrapped++
+	link.conns[sim] = struct{}{}
+	return sim
+}
+
+// Reset abruptly resets every open connection on the link
+func (link *Link) Reset() {
+	link.Lock()
+	conns := make([]*SimConn, 0, len(link.conns))
+	for conn := range link.conns {
+		conns = append(conns, conn)
+	}
+	link.Unlock()
+	for _, conn := range conns {
+		conn.Reset()
+	}
+}
+
+func (link *Link) forget(conn *SimConn) {
+	if link == nil {
+		return
+	}
+	link.Lock()
+	delete(link.conns, conn)
+	link.Unlock()
+}
+
+type simChunk struct {
+	data []byte
+	at   time.Time // when it arrives at the other end
+}
+
+// SimConn delays, throttles and breaks the connection it wraps. Writes are
+// queued and delivered in order by a single goroutine once their time has
+// come, so latency doesn't hold up the writer, only a full queue does
+type SimConn struct {
+	net.Conn
+	conditions LinkConditions
+	link       *Link
+	queue      chan simChunk
+	closing    chan struct{} // closed by Close, queued writes are still delivered
+	reset      chan struct{} // closed by Reset, queued writes are dropped
+
+	writeLock sync.Mutex // keeps writes in order
+
+	sync.Mutex // guards the fields below
+	random     *rand.Rand
+	err        error     // returned by every call once set
+	written    int64     // bytes accepted by Write
+	free       time.Time // when the link has sent everything queued
+	last       time.Time // arrival of the newest queued write
+}
+
+func newSimConn(conn net.Conn, link *Link, seed int64) *SimConn {
+	conditions := link.Conditions
+	if conditions.Loss > 0 && conditions.Retransmit == 0 {
+		conditions.Retransmit = defaultRetransmit
+	}
+	sim := &SimConn{
+		Conn:       conn,
+		conditions: conditions,
+		link:       link,
+		queue:      make(chan simChunk, simQueueLength),
+		closing:    make(chan struct{}),
+		reset:      make(chan struct{}),
+		random:     rand.New(rand.NewSource(seed)),
+	}
+	go sim.deliver()
+	return sim
+}
+
+func (conn *SimConn) Write(data []byte) (int, error) {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	conn.Lock()
+	if conn.err != nil {
+		conn.Unlock()
+		return 0, conn.err
+	}
+	if limit := conn.conditions.ResetAfter; limit > 0 && conn.written+int64(len(data)) > limit {
+		conn.Unlock()
+		conn.Reset()
+		return 0, ErrLinkReset
+	}
+	conn.written += int64(len(data))
+
+	now := time.Now()
+	if conn.free.Before(now) {
+		conn.free = now
+	}
+	if bandwidth := conn.conditions.Bandwidth; bandwidth > 0 {
+		conn.free = conn.free.Add(time.Duration(len(data)) * time.Second / time.Duration(bandwidth))
+	}
+	at := conn.free.Add(conn.conditions.Latency)
+	if jitter := conn.conditions.Jitter; jitter > 0 {
+		at = at.Add(time.Duration(conn.random.Int63n(int64(jitter))))
+	}
+	if conn.conditions.Loss > 0 && conn.random.Float64() < conn.conditions.Loss {
+		at = at.Add(conn.conditions.Retransmit)
+	}
+	// a stream never overtakes itself, whatever the jitter says
+	if at.Before(conn.last) {
+		at = conn.last
+	}
+	conn.last = at
+	conn.Unlock()
+
+	chunk := simChunk{append([]byte(nil), data...), at}
+	select {
+	case conn.queue <- chunk:
+		return len(data), nil
+	case <-conn.closing:
+		return 0, net.ErrClosed
+	case <-conn.reset:
+		return 0, ErrLinkReset
+	}
+}
+
+func (conn *SimConn) deliver() {
+	defer conn.link.forget(conn)
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		var chunk simChunk
+		select {
+		case chunk = <-conn.queue:
+		case <-conn.reset:
+			return
+		case <-conn.closing:
+			// flush what was written before Close, then hang up
+			for {
+				select {
+				case chunk = <-conn.queue:
+					if !conn.send(timer, chunk) {
+						return
+					}
+				default:
+					conn.Conn.Close()
+					return
+				}
+			}
+		}
+		if !conn.send(timer, chunk) {
+			return
+		}
+	}
+}
+
+// send waits for chunk to be due and writes it, false once the link is down
+func (conn *SimConn) send(timer *time.Timer, chunk simChunk) bool {
+	if wait := time.Until(chunk.at); wait > 0 {
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-conn.reset:
+			timer.Stop()
+			return false
+		}
+	}
+	if _, err := conn.Conn.Write(chunk.data); err != nil {
+		conn.fail(err)
+		conn.Conn.Close()
+		return false
+	}
+	return true
+}
+
+func (conn *SimConn) Read(data []byte) (int, error) {
+	if delay := conn.conditions.ReadDelay; delay > 0 {
+		time.Sleep(delay)
+	}
+	if chunk := conn.conditions.ReadChunk; chunk > 0 && len(data) > chunk {
+		data = data[:chunk]
+	}
+	n, err := conn.Conn.Read(data)
+	if err != nil {
+		conn.Lock()
+		if conn.err != nil {
+			err = conn.err
+		}
+		conn.Unlock()
+	}
+	return n, err
+}
+
+// Close stops reading at once and hangs up after delivering queued writes
+func (conn *SimConn) Close() error {
+	if !conn.fail(net.ErrClosed) {
+		return net.ErrClosed
+	}
+	close(conn.closing)
+	conn.Conn.SetReadDeadline(time.Now())
+	conn.Conn.SetWriteDeadline(time.Now().Add(conn.conditions.Latency + conn.conditions.Jitter + conn.conditions.Retransmit + simCloseLinger))
+	return nil
+}
+
+// Reset drops queued writes and closes the connection the hard way, with a
+// TCP reset where the platform allows
+func (conn *SimConn) Reset() {
+	conn.fail(ErrLinkReset)
+	conn.Lock()
+	select {
+	case <-conn.reset:
+		conn.Unlock()
+		return
+	default:
+		close(conn.reset)
+	}
+	conn.Unlock()
+	if tcp, ok := conn.Conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Conn.Close()
+}
+
+// fail records the first error, reporting whether it was the first
+func (conn *SimConn) fail(err error) bool {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.err != nil {
+		return false
+	}
+	conn.err = err
+	return true
+}
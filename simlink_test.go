@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// simPipe returns both ends of an in-memory connection, the first one
+// behind a link with conditions
+func simPipe(t *testing.T, conditions LinkConditions) (*Link, net.Conn, net.Conn) {
+	link := NewLink(conditions)
+	near, far := net.Pipe()
+	conn := link.Wrap(near)
+	t.Cleanup(func() {
+		conn.Close()
+		far.Close()
+	})
+	return link, conn, far
+}
+
+func TestParseLinkConditions(t *testing.T) {
+	conditions, err := ParseLinkConditions("latency=100ms,jitter=20ms,loss=0.01,bandwidth=65536,read-delay=5ms,read-chunk=16,reset=4096,seed=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LinkConditions{
+		Latency:    100 * time.Millisecond,
+		Jitter:     20 * time.Millisecond,
+		Loss:       0.01,
+		Bandwidth:  65536,
+		ReadDelay:  5 * time.Millisecond,
+		ReadChunk:  16,
+		ResetAfter: 4096,
+		Seed:       7,
+	}
+	if conditions != want {
+		t.Errorf("got %+v, want %+v", conditions, want)
+	}
+	for _, bad := range []string{"latency", "latency=soon", "loss=2", "speed=1"} {
+		if _, err := ParseLinkConditions(bad); err == nil {
+			t.Errorf("'%s' was accepted", bad)
+		}
+	}
+}
+
+func TestSimConnLatency(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("latency held up the writer for %v", elapsed)
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(far, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("arrived after %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestSimConnBandwidth(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{Bandwidth: 20000})
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.Write(make([]byte, 400))
+		}
+	}()
+	if _, err := io.ReadFull(far, make([]byte, 4000)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("4000 bytes at 20000 B/s took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestSimConnKeepsOrder(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{
+		Jitter:     20 * time.Millisecond,
+		Loss:       0.3,
+		Retransmit: 5 * time.Millisecond,
+		Seed:       1,
+	})
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			conn.Write([]byte{byte(i)})
+		}
+	}()
+	received := make([]byte, 100)
+	if _, err := io.ReadFull(far, received); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range received {
+		if int(b) != i {
+			t.Fatalf("byte %d arrived as %d", i, b)
+		}
+	}
+}
+
+func TestSimConnReadChunk(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{ReadChunk: 3})
+
+	go far.Write([]byte("0123456789"))
+	var received []byte
+	buffer := make([]byte, 64)
+	for len(received) < 10 {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 3 {
+			t.Fatalf("read returned %d bytes, want at most 3", n)
+		}
+		received = append(received, buffer[:n]...)
+	}
+	if string(received) != "0123456789" {
+		t.Errorf("got '%s'", received)
+	}
+}
+
+func TestSimConnResetAfter(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{ResetAfter: 10})
+
+	go io.Copy(io.Discard, far)
+	if _, err := conn.Write(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(make([]byte, 8)); !errors.Is(err, ErrLinkReset) {
+		t.Fatalf("write past the limit returned %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrLinkReset) {
+		t.Errorf("read after reset returned %v", err)
+	}
+	if _, err := far.Write([]byte{1}); err == nil {
+		t.Error("other end can still write after the reset")
+	}
+}
+
+func TestSimConnCloseFlushes(t *testing.T) {
+	_, conn, far := simPipe(t, LinkConditions{Latency: 30 * time.Millisecond})
+
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	received, err := io.ReadAll(far)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, []byte("bye")) {
+		t.Errorf("got '%s' before the hang up, want 'bye'", received)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after close returned %v", err)
+	}
+}
+
+func TestLinkReset(t *testing.T) {
+	link := NewLink(LinkConditions{Latency: time.Second})
+	var fars []net.Conn
+	for i := 0; i < 2; i++ {
+		near, far := net.Pipe()
+		defer far.Close()
+		conn := link.Wrap(near)
+		defer conn.Close()
+		conn.Write([]byte("never delivered"))
+		fars = append(fars, far)
+	}
+
+	link.Reset()
+	for i, far := range fars {
+		far.SetReadDeadline(time.Now().Add(harnessTimeout))
+		if n, err := far.Read(make([]byte, 64)); err != io.EOF {
+			t.Errorf("connection %d read %d bytes and %v after the reset, want EOF", i, n, err)
+		}
+	}
+}
+
+func TestLinkIsOptional(t *testing.T) {
+	near, far := net.Pipe()
+	defer near.Close()
+	defer far.Close()
+	var link *Link
+	if link.Wrap(near) != near {
+		t.Error("nil link wrapped the connection")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// AcceptLimits bound the work strangers can make a host do before they have
+// logged in: key exchanges and password hashing are expensive on purpose
+type AcceptLimits struct {
+	Workers      int // handshakes and password checks running at once
+	Queue        int // jobs waiting for a worker before new ones are turned away
+	PendingPerIP int // connections from one address not logged in yet, 0 for no limit
+}
+
+var DefaultAcceptLimits = AcceptLimits{
+	Workers:      runtime.NumCPU(),
+	Queue:        32,
+	PendingPerIP: 8,
+}
+
+var ErrWorkPoolBusy = errors.New("too much work queued, try again later")
+
+// WorkPool runs jobs on a fixed number of goroutines with a bounded queue
+type WorkPool struct {
+	jobs chan func()
+}
+
+func NewWorkPool(workers, queue int) *WorkPool {
+	if workers < 1 {
+		workers = 1
+	}
+	pool := &WorkPool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range pool.jobs {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// Do runs job on the pool and waits for it to finish. If every worker is busy
+// and the queue is full it gives up straight away with ErrWorkPoolBusy, so
+// excess work is rejected instead of piling up. A nil pool runs job directly
+func (pool *WorkPool) Do(job func()) error {
+	if pool == nil {
+		job()
+		return nil
+	}
+	done := make(chan struct{})
+	select {
+	case pool.jobs <- func() {
+		defer close(done)
+		job()
+	}:
+	default:
+		return ErrWorkPoolBusy
+	}
+	<-done
+	return nil
+}
+
+// Queued returns how many jobs are waiting for a worker
+func (pool *WorkPool) Queued() int {
+	if pool == nil {
+		return 0
+	}
+	return len(pool.jobs)
+}
+
+// PendingLimiter caps connections per address that haven't logged in yet
+type PendingLimiter struct {
+	sync.Mutex
+	max  int
+	byIP map[string]int
+}
+
+func NewPendingLimiter(max int) *PendingLimiter {
+	return &PendingLimiter{max: max, byIP: make(map[string]int)}
+}
+
+// Acquire counts a new connection from ip, false if ip is at the limit.
+// A nil limiter lets everything through
+func (limiter *PendingLimiter) Acquire(ip string) bool {
+	if limiter == nil {
+		return true
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.max > 0 && limiter.byIP[ip] >= limiter.max {
+		return false
+	}
+	limiter.byIP[ip]++
+	return true
+}
+
+// Release is called once a connection from ip logged in or went away
+func (limiter *PendingLimiter) Release(ip string) {
+	if limiter == nil {
+		return
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.byIP[ip] <= 1 {
+		delete(limiter.byIP, ip)
+	} else {
+		limiter.byIP[ip]--
+	}
+}
+
+// Pending returns the connections from ip that haven't logged in yet
+func (limiter *PendingLimiter) Pending(ip string) int {
+	if limiter == nil {
+		return 0
+	}
+	limiter.Lock()
+	defer limiter.Unlock()
+	return limiter.byIP[ip]
+}
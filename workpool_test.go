@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkPoolRejectsWhenFull(t *testing.T) {
+	pool := NewWorkPool(1, 1)
+	running := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan error, 2)
+
+	go func() {
+		finished <- pool.Do(func() {
+			close(running)
+			<-release
+		})
+	}()
+	<-running
+	go func() {
+		finished <- pool.Do(func() {})
+	}()
+	deadline := time.Now().Add(harnessTimeout)
+	for pool.Queued() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("second job was never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := pool.Do(func() { t.Error("job ran on a full pool") }); !errors.Is(err, ErrWorkPoolBusy) {
+		t.Errorf("full pool returned %v", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-finished; err != nil {
+			t.Errorf("queued job failed: %v", err)
+		}
+	}
+}
+
+func TestNilWorkPoolRunsInline(t *testing.T) {
+	var pool *WorkPool
+	ran := false
+	if err := pool.Do(func() { ran = true }); err != nil || !ran {
+		t.Errorf("nil pool returned %v, ran %v", err, ran)
+	}
+}
+
+func TestPendingLimiter(t *testing.T) {
+	limiter := NewPendingLimiter(2)
+	if !limiter.Acquire("10.0.0.1") || !limiter.Acquire("10.0.0.1") {
+		t.Fatal("rejected below the limit")
+	}
+	if limiter.Acquire("10.0.0.1") {
+		t.Error("accepted past the limit")
+	}
+	if !limiter.Acquire("10.0.0.2") {
+		t.Error("limit applied across addresses")
+	}
+	limiter.Release("10.0.0.1")
+	if !limiter.Acquire("10.0.0.1") {
+		t.Error("release did not free a slot")
+	}
+	limiter.Release("10.0.0.1")
+	limiter.Release("10.0.0.1")
+	limiter.Release("10.0.0.1")
+	if pending := limiter.Pending("10.0.0.1"); pending != 0 {
+		t.Errorf("%d pending after releasing everything", pending)
+	}
+}